@@ -1,63 +1,454 @@
 package collector
 
 import (
-	"sync"
-	"time"
+	"container/list"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ prometheus.Collector = &ScrapeCache{}
+
+const (
+	cacheFileExt   = ".json" // extension of the entry files in the cache directory
+	cacheTmpPrefix = ".tmp-" // prefix of entry files being written
+
+	cacheSweepInterval = time.Minute // minimum time between sweeps of expired entries
+
+	// cacheVersion is increased whenever the serialized ScrapeResult changes, so persisted
+	// entries of older versions are discarded instead of loaded with missing fields
+	cacheVersion = 2
 )
 
+// CacheConfig configures a ScrapeCache
+type CacheConfig struct {
+	TTL        time.Duration // cache duration, 0 disables the cache
+	Grace      time.Duration // expired results are served stale for this period while they are refreshed
+	Dir        string        // persists the entries in the directory if set, so they survive restarts
+	MaxEntries int           // number of entries kept, 0 does not limit them
+	MaxBytes   int64         // size of the entries kept in bytes, 0 does not limit it
+}
+
 type cacheEntry struct {
+	Version   int
 	Result    *ScrapeResult
 	ExpiresAt time.Time
 }
 
-type scrapeCache struct {
-	entries map[string]cacheEntry
-	mutex   sync.Mutex
-	ttl     time.Duration
+// cacheItem is an entry in the LRU list of the cache
+type cacheItem struct {
+	key   string
+	entry cacheEntry
+	size  int64  // size of the serialized entry
+	gen   uint64 // increased whenever the entry is replaced, so a late write of an older entry is skipped
 }
 
-func newScrapeCache(ttl time.Duration) *scrapeCache {
-	if ttl <= 0 {
-		return nil
+// ScrapeCache keeps scrape results for a TTL. Once it exceeds its bounds the least
+// recently used entries are evicted, expired entries are swept periodically.
+type ScrapeCache struct {
+	config CacheConfig
+
+	items     map[string]*list.Element
+	lru       *list.List // most recently used first
+	bytes     int64
+	lastSweep time.Time
+	evicted   []string // keys of removed entries whose files are deleted once the mutex is released
+	gen       uint64
+	mutex     sync.Mutex
+	files     sync.Mutex // serializes the writes and removals of entry files, which are done without holding mutex
+
+	hits      map[string]float64 // keyed by state
+	misses    float64
+	evictions map[string]float64 // keyed by reason
+
+	hitsDesc      *prometheus.Desc
+	missesDesc    *prometheus.Desc
+	evictionsDesc *prometheus.Desc
+	entriesDesc   *prometheus.Desc
+	bytesDesc     *prometheus.Desc
+}
+
+// NewScrapeCache creates a cache for the configuration. It returns nil, which does not
+// cache at all, if the TTL is 0. If a directory is set, the entries still valid are
+// loaded from it.
+func NewScrapeCache(config CacheConfig) (*ScrapeCache, error) {
+	if config.TTL <= 0 {
+		return nil, nil
 	}
-	return &scrapeCache{
-		entries: make(map[string]cacheEntry),
-		ttl:     ttl,
+	c := &ScrapeCache{
+		config:        config,
+		items:         make(map[string]*list.Element),
+		lru:           list.New(),
+		lastSweep:     time.Now(),
+		hits:          map[string]float64{"fresh": 0, "stale": 0},
+		evictions:     map[string]float64{"capacity": 0, "expired": 0},
+		hitsDesc:      prometheus.NewDesc(fqname("cache_hits_total"), "Total scrapes answered from the cache by the state of the result", []string{"state"}, nil),
+		missesDesc:    prometheus.NewDesc(fqname("cache_misses_total"), "Total scrapes not found in the cache", nil, nil),
+		evictionsDesc: prometheus.NewDesc(fqname("cache_evictions_total"), "Total entries removed from the cache by reason", []string{"reason"}, nil),
+		entriesDesc:   prometheus.NewDesc(fqname("cache_entries"), "Number of entries in the cache", nil, nil),
+		bytesDesc:     prometheus.NewDesc(fqname("cache_size_bytes"), "Size of the entries in the cache, serialized as JSON", nil, nil),
+	}
+
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+			return nil, errors.Wrap(err, "could not create cache directory")
+		}
+		if err := c.load(); err != nil {
+			return nil, errors.Wrap(err, "could not load cache directory")
+		}
 	}
+
+	return c, nil
 }
 
-func (c *scrapeCache) get(key string) (*ScrapeResult, bool) {
+// get returns the cached result of the first key found and whether it expired and is within the grace period.
+// Results expired beyond the grace period are a miss, but the first one is returned with ok false to fall
+// back to if its refresh fails. They are kept until they are replaced or swept.
+func (c *ScrapeCache) get(keys ...string) (result *ScrapeResult, stale bool, ok bool) {
 	if c == nil {
-		return nil, false
+		return nil, false, false
 	}
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	entry, ok := c.entries[key]
-	if !ok || time.Now().After(entry.ExpiresAt) {
-		if ok {
-			delete(c.entries, key)
+	defer c.unlock()
+
+	now := time.Now()
+	var item, expired *cacheItem
+	for _, key := range keys {
+		element, found := c.items[key]
+		if !found {
+			continue
+		}
+		if now.After(element.Value.(*cacheItem).entry.ExpiresAt.Add(c.config.Grace)) {
+			if expired == nil {
+				expired = element.Value.(*cacheItem)
+			}
+			continue
 		}
-		return nil, false
+
+		c.lru.MoveToFront(element)
+		item = element.Value.(*cacheItem)
+		break
+	}
+	if item == nil {
+		c.misses++
+		if expired != nil {
+			return flagExpired(expired.entry), true, false
+		}
+		return nil, false, false
+	}
+
+	if now.After(item.entry.ExpiresAt) {
+		c.hits["stale"]++
+		return flagExpired(item.entry), true, true
 	}
-	return entry.Result, true
+	c.hits["fresh"]++
+	return item.entry.Result, false, true
 }
 
-func (c *scrapeCache) set(key string, result *ScrapeResult) {
+// flagExpired copies the result of an entry to flag it without touching the cached one
+func flagExpired(entry cacheEntry) *ScrapeResult {
+	result := *entry.Result
+	result.ExpiredAt = entry.ExpiresAt
+	return &result
+}
+
+func (c *ScrapeCache) set(key string, result *ScrapeResult) {
 	if c == nil {
 		return
 	}
+	entry := cacheEntry{
+		Version:   cacheVersion,
+		Result:    result,
+		ExpiresAt: time.Now().Add(c.config.TTL),
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.WithError(err).WithField("target", result.Request.Url).Warn("could not serialize cache entry")
+		return
+	}
+
+	c.mutex.Lock()
+	gen := c.add(key, entry, int64(len(b)))
+	c.sweep()
+	c.unlock()
+
+	if err := c.persist(key, gen, b); err != nil {
+		log.WithError(err).WithField("target", result.Request.Url).Warn("could not persist cache entry")
+	}
+}
+
+// add puts the entry in front of the LRU list and evicts the least recently used
+// entries exceeding the bounds of the cache, except for the added one. It returns the
+// generation of the entry.
+func (c *ScrapeCache) add(key string, entry cacheEntry, size int64) uint64 {
+	c.gen++
+	if element, ok := c.items[key]; ok {
+		item := element.Value.(*cacheItem)
+		c.bytes += size - item.size
+		item.entry, item.size, item.gen = entry, size, c.gen
+		c.lru.MoveToFront(element)
+	} else {
+		c.items[key] = c.lru.PushFront(&cacheItem{key: key, entry: entry, size: size, gen: c.gen})
+		c.bytes += size
+	}
+
+	for c.lru.Len() > 1 && c.exceeded() {
+		c.removeElement(c.lru.Back(), "capacity")
+	}
+	return c.gen
+}
+
+// exceeded returns true if the cache holds more entries or bytes than allowed
+func (c *ScrapeCache) exceeded() bool {
+	return (c.config.MaxEntries > 0 && c.lru.Len() > c.config.MaxEntries) ||
+		(c.config.MaxBytes > 0 && c.bytes > c.config.MaxBytes)
+}
+
+// sweep removes the entries expired beyond the grace period once per sweep interval
+func (c *ScrapeCache) sweep() {
+	now := time.Now()
+	if now.Sub(c.lastSweep) < cacheSweepInterval {
+		return
+	}
+	c.lastSweep = now
+
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if now.After(element.Value.(*cacheItem).entry.ExpiresAt.Add(c.config.Grace)) {
+			c.removeElement(element, "expired")
+		}
+		element = next
+	}
+}
+
+func (c *ScrapeCache) removeElement(element *list.Element, reason string) {
+	item := element.Value.(*cacheItem)
+	c.lru.Remove(element)
+	delete(c.items, item.key)
+	c.bytes -= item.size
+	c.evictions[reason]++
+	c.evicted = append(c.evicted, item.key)
+}
+
+// unlock releases the mutex and deletes the files of the entries removed while it was held,
+// so disk I/O does not block other scrapes using the cache
+func (c *ScrapeCache) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.mutex.Unlock()
+
+	for _, key := range evicted {
+		c.remove(key)
+	}
+}
+
+// load reads all entries still valid from the cache directory. Unreadable
+// and expired entry files are removed, so a corrupt file only loses its entry.
+func (c *ScrapeCache) load() error {
+	files, err := os.ReadDir(c.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, f := range files {
+		name := f.Name()
+		path := filepath.Join(c.config.Dir, name)
+		if strings.HasPrefix(name, cacheTmpPrefix) {
+			// left behind by an interrupted write
+			_ = os.Remove(path)
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(name, cacheFileExt) {
+			continue
+		}
+
+		key, errKey := hex.DecodeString(strings.TrimSuffix(name, cacheFileExt))
+		entry, size, errRead := readCacheEntry(path)
+		if errKey != nil || errRead != nil {
+			log.WithError(errRead).WithField("file", path).Warn("removing unreadable cache entry")
+			_ = os.Remove(path)
+			continue
+		}
+
+		if now.After(entry.ExpiresAt.Add(c.config.Grace)) {
+			_ = os.Remove(path)
+			continue
+		}
+		c.add(string(key), entry, size)
+	}
+	for _, key := range c.evicted {
+		c.remove(key)
+	}
+	c.evicted = nil
+
+	log.WithField("entries", c.lru.Len()).WithField("dir", c.config.Dir).Info("loaded scrape cache")
+	return nil
+}
+
+func readCacheEntry(path string) (entry cacheEntry, size int64, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return entry, 0, err
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return entry, 0, err
+	}
+	if entry.Version != cacheVersion {
+		return entry, 0, errors.Errorf("cache entry of version %d, want %d", entry.Version, cacheVersion)
+	}
+	if entry.Result == nil {
+		return entry, 0, errors.New("cache entry without result")
+	}
+	return entry, int64(len(b)), nil
+}
+
+// persist writes the serialized entry of the generation to its file if the cache is persisted.
+// The entry is not written if it was evicted or replaced in the meantime, so a late write
+// neither leaves an orphaned file behind nor overwrites a newer entry.
+func (c *ScrapeCache) persist(key string, gen uint64, b []byte) error {
+	if c.config.Dir == "" {
+		return nil
+	}
+	c.files.Lock()
+	defer c.files.Unlock()
+
+	c.mutex.Lock()
+	element, ok := c.items[key]
+	current := ok && element.Value.(*cacheItem).gen == gen
+	c.mutex.Unlock()
+	if !current {
+		return nil
+	}
+	return c.write(key, b)
+}
+
+// write stores the serialized entry in a temporary file renamed to the entry file,
+// so a crash never leaves a partially written entry behind
+func (c *ScrapeCache) write(key string, b []byte) error {
+	tmp, err := os.CreateTemp(c.config.Dir, cacheTmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// remove deletes the entry file if the cache is persisted, unless the key was added again in the meantime
+func (c *ScrapeCache) remove(key string) {
+	if c.config.Dir == "" {
+		return
+	}
+	c.files.Lock()
+	defer c.files.Unlock()
+
+	c.mutex.Lock()
+	_, ok := c.items[key]
+	c.mutex.Unlock()
+	if ok {
+		return
+	}
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warn("could not remove cache entry")
+	}
+}
+
+func (c *ScrapeCache) path(key string) string {
+	return filepath.Join(c.config.Dir, hex.EncodeToString([]byte(key))+cacheFileExt)
+}
+
+// Describe implements prometheus.Collector.
+func (c *ScrapeCache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hitsDesc
+	ch <- c.missesDesc
+	ch <- c.evictionsDesc
+	ch <- c.entriesDesc
+	ch <- c.bytesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *ScrapeCache) Collect(ch chan<- prometheus.Metric) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.entries[key] = cacheEntry{
-		Result:    result,
-		ExpiresAt: time.Now().Add(c.ttl),
+
+	for state, v := range c.hits {
+		ch <- prometheus.MustNewConstMetric(c.hitsDesc, prometheus.CounterValue, v, state)
 	}
+	ch <- prometheus.MustNewConstMetric(c.missesDesc, prometheus.CounterValue, c.misses)
+	for reason, v := range c.evictions {
+		ch <- prometheus.MustNewConstMetric(c.evictionsDesc, prometheus.CounterValue, v, reason)
+	}
+	ch <- prometheus.MustNewConstMetric(c.entriesDesc, prometheus.GaugeValue, float64(c.lru.Len()))
+	ch <- prometheus.MustNewConstMetric(c.bytesDesc, prometheus.GaugeValue, float64(c.bytes))
 }
 
+// cacheKeyFromRequest returns the key of the result of a request. Only the fields changing
+// the result are part of the key and they are normalized, so equivalent requests share it.
 func cacheKeyFromRequest(req ScrapeRequest) string {
-	b, _ := json.Marshal(req)
+	b, _ := json.Marshal(struct {
+		Url        string
+		Strategy   Strategy
+		Campaign   string
+		Source     string
+		Locale     string
+		Categories []string
+		Runs       int
+	}{
+		Url:        normalizeURL(req.Url),
+		Strategy:   req.Strategy,
+		Campaign:   req.Campaign,
+		Source:     req.Source,
+		Locale:     req.Locale,
+		Categories: normalizeCategories(req.Categories),
+		Runs:       req.runs(),
+	})
 	h := sha256.Sum256(b)
 	return string(h[:])
 }
+
+// normalizeURL lower cases the scheme and host and removes default ports and fragments
+func normalizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+// normalizeCategories returns the sorted categories without duplicates
+func normalizeCategories(categories []string) []string {
+	normalized := slices.Clone(categories)
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
@@ -0,0 +1,270 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// expire sets the expiry of a cache entry
+func expire(c *ScrapeCache, key string, expiresAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.items[key].Value.(*cacheItem).entry.ExpiresAt = expiresAt
+}
+
+func Test_ScrapeCachePersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour, Dir: dir})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+
+	request := ScrapeRequest{Url: "https://example.com/", Strategy: StrategyMobile}
+	key := cacheKeyFromRequest(request)
+	cache.set(key, &ScrapeResult{
+		Request:   request,
+		Result:    &Result{Lighthouse: &LighthouseResult{TotalDuration: 1234}},
+		Timestamp: time.Now(),
+	})
+
+	// expired, corrupt and leftover temporary files are discarded on load
+	expired := cacheKeyFromRequest(ScrapeRequest{Url: "https://example.com/expired", Strategy: StrategyMobile})
+	cache.config.TTL = -time.Hour
+	cache.set(expired, &ScrapeResult{Request: ScrapeRequest{Url: "https://example.com/expired"}})
+
+	corrupt := filepath.Join(dir, "00ff"+cacheFileExt)
+	tmp := filepath.Join(dir, cacheTmpPrefix+"123")
+	for _, f := range []string{corrupt, tmp} {
+		if err := os.WriteFile(f, []byte(`{"Result":`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := NewScrapeCache(CacheConfig{TTL: time.Hour, Dir: dir})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+
+	got, _, ok := loaded.get(key)
+	if !ok {
+		t.Fatal("cached result should be loaded from the cache directory")
+	}
+	if got.Request.Url != request.Url || got.Result.Lighthouse.TotalDuration != 1234 {
+		t.Errorf("loaded result = %+v, want the cached result", got)
+	}
+	if loaded.lru.Len() != 1 {
+		t.Errorf("loaded %d entries, want 1", loaded.lru.Len())
+	}
+
+	for _, f := range []string{corrupt, tmp, cache.path(expired)} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed on load", filepath.Base(f))
+		}
+	}
+}
+
+func Test_ScrapeCacheGrace(t *testing.T) {
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour, Grace: time.Hour})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+
+	result := &ScrapeResult{Request: ScrapeRequest{Url: "https://example.com/"}}
+	cache.set("key", result)
+
+	if got, stale, ok := cache.get("key"); !ok || stale || got != result {
+		t.Errorf("get() = %v, %v, %v, want the fresh result", got, stale, ok)
+	}
+
+	expiresAt := time.Now().Add(-time.Minute)
+	expire(cache, "key", expiresAt)
+	got, stale, ok := cache.get("key")
+	if !ok || !stale || !got.ExpiredAt.Equal(expiresAt) {
+		t.Errorf("get() = %v, %v, %v, want the stale result", got, stale, ok)
+	}
+	if !result.ExpiredAt.IsZero() {
+		t.Error("get() should not flag the cached result")
+	}
+
+	expire(cache, "key", time.Now().Add(-2*time.Hour))
+	got, stale, ok = cache.get("key")
+	if ok {
+		t.Error("get() should not return results expired longer than the grace period")
+	}
+	if got == nil || !stale {
+		t.Errorf("get() = %v, %v, want the expired result to fall back to", got, stale)
+	}
+}
+
+func Test_ScrapeCacheEviction(t *testing.T) {
+	tests := []struct {
+		name   string
+		config CacheConfig
+		want   []string
+	}{
+		{"unbounded", CacheConfig{TTL: time.Hour}, []string{"0", "1", "2", "3"}},
+		{"max entries", CacheConfig{TTL: time.Hour, MaxEntries: 3}, []string{"0", "2", "3"}},
+		{"max bytes", CacheConfig{TTL: time.Hour, MaxBytes: 1}, []string{"3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := NewScrapeCache(tt.config)
+			if err != nil {
+				t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+			}
+
+			cache.set("0", &ScrapeResult{})
+			cache.set("1", &ScrapeResult{})
+			cache.set("2", &ScrapeResult{})
+			cache.get("0") // the least recently used entry is 1 now
+			cache.set("3", &ScrapeResult{})
+
+			var got []string
+			for i := 0; i < 4; i++ {
+				key := fmt.Sprint(i)
+				if _, ok := cache.items[key]; ok {
+					got = append(got, key)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("cached keys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ScrapeCacheEvictionFiles(t *testing.T) {
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour, MaxEntries: 1, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+
+	cache.set("0", &ScrapeResult{})
+	cache.set("1", &ScrapeResult{})
+	if _, err := os.Stat(cache.path("0")); !os.IsNotExist(err) {
+		t.Error("file of the entry evicted for capacity should be removed")
+	}
+
+	expire(cache, "1", time.Now().Add(-time.Minute))
+	cache.mutex.Lock()
+	cache.lastSweep = time.Now().Add(-cacheSweepInterval)
+	cache.sweep()
+	cache.unlock()
+	if _, err := os.Stat(cache.path("1")); !os.IsNotExist(err) {
+		t.Error("file of the expired entry should be removed")
+	}
+	if len(cache.evicted) != 0 {
+		t.Errorf("%d evicted keys left after releasing the mutex, want 0", len(cache.evicted))
+	}
+}
+
+func Test_ScrapeCacheEvictedWhileWritten(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour, MaxEntries: 1, Dir: dir})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+
+	// the entry is added, but its file is written only after it was evicted by another set
+	entry := cacheEntry{Version: cacheVersion, Result: &ScrapeResult{}, ExpiresAt: time.Now().Add(time.Hour)}
+	b, _ := json.Marshal(entry)
+	cache.mutex.Lock()
+	gen := cache.add("0", entry, int64(len(b)))
+	cache.unlock()
+
+	cache.set("1", &ScrapeResult{})
+	if err := cache.persist("0", gen, b); err != nil {
+		t.Fatalf("persist() should not throw an error: %v", err)
+	}
+
+	if _, err := os.Stat(cache.path("0")); !os.IsNotExist(err) {
+		t.Error("file of the entry evicted while it was written should not be left behind")
+	}
+	loaded, err := NewScrapeCache(CacheConfig{TTL: time.Hour, Dir: dir})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+	if _, ok := loaded.items["0"]; ok || loaded.lru.Len() != 1 {
+		t.Errorf("loaded %d entries, want only the entry not evicted", loaded.lru.Len())
+	}
+
+	// a late write of a replaced entry does not overwrite the newer one
+	cache.set("1", &ScrapeResult{Request: ScrapeRequest{Url: "https://example.com/new"}})
+	if err := cache.persist("1", gen, b); err != nil {
+		t.Fatalf("persist() should not throw an error: %v", err)
+	}
+	if persisted, _, err := readCacheEntry(cache.path("1")); err != nil || persisted.Result.Request.Url != "https://example.com/new" {
+		t.Errorf("persisted entry = %+v, %v, want the newer entry", persisted.Result, err)
+	}
+}
+
+func Test_ScrapeCacheSweep(t *testing.T) {
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+
+	cache.set("expired", &ScrapeResult{})
+	expire(cache, "expired", time.Now().Add(-time.Minute))
+	cache.lastSweep = time.Now().Add(-cacheSweepInterval)
+	cache.set("fresh", &ScrapeResult{})
+
+	if _, ok := cache.items["expired"]; ok {
+		t.Error("expired entries should be swept")
+	}
+
+	expected := `
+# HELP pagespeed_cache_entries Number of entries in the cache
+# TYPE pagespeed_cache_entries gauge
+pagespeed_cache_entries 1
+# HELP pagespeed_cache_evictions_total Total entries removed from the cache by reason
+# TYPE pagespeed_cache_evictions_total counter
+pagespeed_cache_evictions_total{reason="capacity"} 0
+pagespeed_cache_evictions_total{reason="expired"} 1
+`
+	if err := testutil.CollectAndCompare(cache, strings.NewReader(expected), "pagespeed_cache_entries", "pagespeed_cache_evictions_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_cacheKeyFromRequest(t *testing.T) {
+	base := ScrapeRequest{Url: "https://example.com/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance, CategorySEO}}
+
+	tests := []struct {
+		name   string
+		modify func(r *ScrapeRequest)
+		same   bool
+	}{
+		{"category order", func(r *ScrapeRequest) { r.Categories = []string{CategorySEO, CategoryPerformance} }, true},
+		{"duplicate categories", func(r *ScrapeRequest) { r.Categories = []string{CategorySEO, CategoryPerformance, CategorySEO} }, true},
+		{"upper case host", func(r *ScrapeRequest) { r.Url = "HTTPS://Example.COM/" }, true},
+		{"default port", func(r *ScrapeRequest) { r.Url = "https://example.com:443/" }, true},
+		{"empty path", func(r *ScrapeRequest) { r.Url = "https://example.com" }, true},
+		{"fragment", func(r *ScrapeRequest) { r.Url = "https://example.com/#top" }, true},
+		{"scheduling", func(r *ScrapeRequest) { r.Interval, r.Priority = Duration(time.Minute), 10 }, true},
+		{"single run", func(r *ScrapeRequest) { r.Runs = 1 }, true},
+		{"path", func(r *ScrapeRequest) { r.Url = "https://example.com/Path" }, false},
+		{"query", func(r *ScrapeRequest) { r.Url = "https://example.com/?a=b" }, false},
+		{"strategy", func(r *ScrapeRequest) { r.Strategy = StrategyDesktop }, false},
+		{"categories", func(r *ScrapeRequest) { r.Categories = []string{CategoryPerformance} }, false},
+		{"runs", func(r *ScrapeRequest) { r.Runs = 3 }, false},
+		{"locale", func(r *ScrapeRequest) { r.Locale = "de" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := base
+			tt.modify(&r)
+			if same := cacheKeyFromRequest(r) == cacheKeyFromRequest(base); same != tt.same {
+				t.Errorf("same cache key = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
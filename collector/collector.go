@@ -1,9 +1,12 @@
 package collector
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -11,99 +14,350 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/api/option"
-	"google.golang.org/api/pagespeedonline/v5"
 )
 
 var (
-	_ Factory = factory{}
+	_ Factory   = &factory{}
+	_ io.Closer = collector{}
 )
 
-var (
-	timeValueRe = regexp.MustCompile(`(\d*[.]?\d+(ms|s))|0`)
-	timeUnitRe  = regexp.MustCompile(`(ms|s)`)
-)
+// distributionCategories are the CrUX histogram buckets in the order returned by the API
+var distributionCategories = []string{"fast", "average", "slow"}
 
 type Factory interface {
 	Create(config Config) (prometheus.Collector, error)
 }
 
-func NewFactory() Factory {
-	return factory{}
+// FactoryOption configures state shared by all collectors created by a factory
+type FactoryOption func(f *factory)
+
+// WithRateLimiter shares the rate limiter between all collectors of the factory
+func WithRateLimiter(limiter *RateLimiter) FactoryOption {
+	return func(f *factory) {
+		f.limiter = limiter
+	}
+}
+
+// WithRetryPolicy shares the retry policy between all collectors of the factory
+func WithRetryPolicy(retry *RetryPolicy) FactoryOption {
+	return func(f *factory) {
+		f.retry = retry
+	}
+}
+
+// WithRequestGroup coalesces identical requests in flight across all collectors of the factory
+func WithRequestGroup(group *RequestGroup) FactoryOption {
+	return func(f *factory) {
+		f.group = group
+	}
+}
+
+// WithHostConcurrency limits the targets of the same host scraped at the same time by all collectors of the
+// factory, including probes. Their own host concurrency settings are ignored then, 0 does not limit them.
+func WithHostConcurrency(limit int) FactoryOption {
+	return func(f *factory) {
+		f.hosts = newHostLimiter(limit)
+	}
+}
+
+// WithCache shares the cache between all collectors of the factory, their own cache settings are ignored then
+func WithCache(cache *ScrapeCache) FactoryOption {
+	return func(f *factory) {
+		f.cache = cache
+	}
+}
+
+// WithTransport sends the requests of all collectors of the factory to the google APIs through the
+// transport, e.g. created by NewTransport with a proxy and custom root certificates
+func WithTransport(transport http.RoundTripper) FactoryOption {
+	return func(f *factory) {
+		f.transport = transport
+	}
+}
+
+// WithEndpoint calls the PageSpeed Insights API at the base URL, e.g. of a mirror or a fake
+func WithEndpoint(endpoint string) FactoryOption {
+	return func(f *factory) {
+		f.endpoint = endpoint
+	}
+}
+
+// WithKeyPool authenticates the PageSpeed Insights API requests of all collectors of the factory with the
+// keys of the pool. The API key and credentials file of the configs are only used for the CrUX APIs then.
+func WithKeyPool(keys *KeyPool) FactoryOption {
+	return func(f *factory) {
+		f.keys = keys
+	}
+}
+
+// WithRecording saves the raw PageSpeed Insights API responses of all collectors of the factory to the directory,
+// one file per request. Error responses are not recorded.
+func WithRecording(dir string) FactoryOption {
+	return func(f *factory) {
+		f.recordDir = dir
+		f.replay = false
+	}
+}
+
+// WithReplay answers the PageSpeed Insights API requests of all collectors of the factory with the responses
+// recorded to the directory by WithRecording, without calling the API. Requests without a recording fail with a 404.
+func WithReplay(dir string) FactoryOption {
+	return func(f *factory) {
+		f.recordDir = dir
+		f.replay = true
+	}
+}
+
+// WithLighthouseCLI runs lighthouse with the binary at the path instead of the PageSpeed Insights API.
+// The chrome flags are passed to the browser launched by lighthouse, e.g. "--headless".
+func WithLighthouseCLI(path string, chromeFlags string) FactoryOption {
+	return func(f *factory) {
+		f.lighthousePath = path
+		f.lighthouseChromeFlags = chromeFlags
+	}
+}
+
+// WithCrUXAPI looks up the field data of targets in the Chrome UX Report API at the endpoint. Combined with
+// WithLighthouseCLI it adds the field data to the lab data of lighthouse, otherwise lighthouse is not run at all.
+// Records are reused for the interval, 0 looks them up on every scrape.
+func WithCrUXAPI(endpoint string, interval time.Duration) FactoryOption {
+	return func(f *factory) {
+		f.cruxEndpoint = endpoint
+		f.cruxRecords = newCrUXRecords[*LoadingExperience](interval)
+	}
+}
+
+// WithCrUXHistory adds the weekly field data of the last 25 collection periods of targets from the
+// CrUX History API at the endpoint to the results. Records are reused for the interval, 0 looks them up on every scrape.
+func WithCrUXHistory(endpoint string, interval time.Duration) FactoryOption {
+	return func(f *factory) {
+		f.cruxHistoryEndpoint = endpoint
+		f.cruxHistory = newCrUXRecords[*LoadingExperienceHistory](interval)
+	}
+}
+
+func NewFactory(options ...FactoryOption) Factory {
+	f := &factory{}
+	for _, o := range options {
+		o(f)
+	}
+	return f
 }
 
 type factory struct {
+	cache                 *ScrapeCache
+	limiter               *RateLimiter
+	group                 *RequestGroup
+	retry                 *RetryPolicy
+	hosts                 *hostLimiter // nil limits the scrapes per host of each collector by its config
+	lighthousePath        string       // empty uses the PageSpeed Insights API
+	lighthouseChromeFlags string
+	cruxEndpoint          string // empty does not use the CrUX API
+	cruxRecords           *cruxRecords[*LoadingExperience]
+	cruxHistoryEndpoint   string // empty does not use the CrUX History API
+	cruxHistory           *cruxRecords[*LoadingExperienceHistory]
+	transport             http.RoundTripper // nil uses http.DefaultTransport
+	endpoint              string            // empty uses the PageSpeed Insights API of google
+	keys                  *KeyPool          // nil authenticates with the API key or credentials file of the config
+	recordDir             string            // empty neither records nor replays responses
+	replay                bool              // replays the responses recorded to recordDir instead of recording them
+}
+
+// newBackend creates the backend collecting the results of a collector. The auth options authenticate
+// the requests to the google APIs unless the PageSpeed Insights API requests are authenticated by a key pool.
+func (f *factory) newBackend(config Config, auth []option.ClientOption, options []option.ClientOption) (b backend, err error) {
+	if f.lighthousePath != "" {
+		b = &lighthouseBackend{path: f.lighthousePath, chromeFlags: f.lighthouseChromeFlags, timeout: config.ScrapeTimeout}
+	}
+
+	var cruxHTTPClient *http.Client
+	if f.cruxEndpoint != "" || f.cruxHistoryEndpoint != "" {
+		cruxHTTPClient, err = newGoogleClient(config.ScrapeTimeout, f.transport, slices.Concat(auth, options))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if f.cruxEndpoint != "" {
+		field := &cruxBackend{client: &cruxClient{endpoint: f.cruxEndpoint, client: cruxHTTPClient}, records: f.cruxRecords}
+		if b != nil {
+			b = &fieldDataBackend{lab: b, field: field}
+		} else {
+			b = field
+		}
+	}
+
+	if b == nil {
+		if b, err = f.newPSIBackend(config, auth, options); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.cruxHistoryEndpoint != "" {
+		b = &historyBackend{next: b, client: &cruxClient{endpoint: f.cruxHistoryEndpoint, client: cruxHTTPClient}, records: f.cruxHistory}
+	}
+	return b, nil
+}
+
+// newPSIBackend creates the backend of the PageSpeed Insights API, recording or replaying its responses if configured
+func (f *factory) newPSIBackend(config Config, auth []option.ClientOption, options []option.ClientOption) (*psiBackend, error) {
+	transport := f.transport
+	if f.recordDir != "" {
+		recorder, err := newRecordTransport(f.transport, f.recordDir, f.replay)
+		if err != nil {
+			return nil, err
+		}
+		if f.replay {
+			// the API is not called, so requests need no keys and are neither rate limited nor retried
+			return newPSIBackend(config.ScrapeTimeout, recorder, nil, nil, append(slices.Clone(options), option.WithoutAuthentication()))
+		}
+		transport = recorder
+	}
+
+	if f.keys == nil {
+		options = slices.Concat(auth, options)
+	}
+	return newPSIBackend(config.ScrapeTimeout, transport, f.limiter, f.keys, options)
 }
 
 type collector struct {
+	ctx           context.Context
+	timeout       time.Duration
 	requests      []ScrapeRequest
 	scrapeService scrapeService
-	parallel      bool
-}
-
-func (factory) Create(config Config) (prometheus.Collector, error) {
-	return newCollector(config)
+	scheduler     *scheduler // nil if targets are scraped on collect
+	descs         *descriptors
 }
 
-var timeAuditMetrics = map[string]bool{
-	"first-contentful-paint":    true,
-	"first-cpu-idle":            true,
-	"first-meaningful-paint":    false,
-	"interactive":               true,
-	"speed-index":               true,
-	"bootup-time":               true,
-	"largest-contentful-paint":  true,
-	"mainthread-work-breakdown": true,
-	"cumulative-layout-shift":   true,
-	"total-blocking-time":       true,
-	"server-response-time":      true,
-	"max-potential-fid":         true,
-	"estimated-input-latency":   true,
+func (f *factory) Create(config Config) (prometheus.Collector, error) {
+	return newCollector(config, f)
 }
 
-func newCollector(config Config) (coll prometheus.Collector, err error) {
-	var options []option.ClientOption
+func newCollector(config Config, f *factory) (coll prometheus.Collector, err error) {
+	var auth, options []option.ClientOption
 	if config.GoogleAPIKey != "" {
-		options = append(options, option.WithAPIKey(config.GoogleAPIKey))
+		auth = append(auth, option.WithAPIKey(config.GoogleAPIKey))
 	}
 
 	if config.CredentialsFile != "" {
-		options = append(options, option.WithCredentialsFile(config.CredentialsFile))
+		auth = append(auth, option.WithCredentialsFile(config.CredentialsFile))
 	}
 
-	svc, err := newPagespeedScrapeService(config.ScrapeTimeout, config.CacheTTL, options...)
+	if f.endpoint != "" {
+		options = append(options, option.WithEndpoint(f.endpoint))
+	}
+
+	cache := f.cache
+	if cache == nil {
+		cache, err = NewScrapeCache(CacheConfig{TTL: config.CacheTTL, Grace: config.CacheGrace, Dir: config.CacheDir})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := f.newBackend(config, auth, options)
 	if err != nil {
 		return nil, err
 	}
 
-	return collector{
-		requests:      config.ScrapeRequests,
+	retry := f.retry
+	if f.replay {
+		// a replayed response does not change when it is retried
+		retry = nil
+	}
+
+	svc, err := newPagespeedScrapeService(scrapeServiceConfig{
+		clientTimeout:   config.ScrapeTimeout,
+		cache:           cache,
+		concurrency:     config.concurrency(),
+		hostConcurrency: config.HostConcurrency,
+		hosts:           f.hosts,
+		limiter:         f.limiter,
+		group:           f.group,
+		retry:           retry,
+		backend:         b,
+		options:         slices.Concat(auth, options),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// collectors bound to a request scrape all targets on collect, a scheduler would outlive the request
+	ctx, scoped := config.Context, config.Context != nil
+	if !scoped {
+		ctx = context.Background()
+	}
+
+	c := collector{
+		ctx:           ctx,
+		timeout:       config.ScrapeTimeout,
 		scrapeService: svc,
-		parallel:      config.Parallel,
-	}, nil
+		descs:         newDescriptors(),
+	}
+
+	// targets are refreshed in the background if they define their own timing or a scrape interval
+	// is configured, all others are scraped on collect
+	var scheduled []ScrapeRequest
+	for _, r := range config.ScrapeRequests {
+		if !scoped && (config.ScrapeInterval > 0 || r.IsScheduled()) {
+			scheduled = append(scheduled, r)
+		} else {
+			c.requests = append(c.requests, r)
+		}
+	}
+
+	if len(scheduled) > 0 {
+		c.scheduler = newScheduler(ctx, svc, config.ScrapeInterval, config.concurrency(), scheduled)
+		c.scheduler.start()
+	}
+
+	return c, nil
+}
+
+// Close stops refreshing the targets in the background
+func (c collector) Close() error {
+	if c.scheduler != nil {
+		c.scheduler.stop()
+	}
+	return nil
 }
 
 // Describe implements Prometheus.Collector.
 func (c collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+	c.descs.describe(ch)
 }
 
 // Collect implements Prometheus.Collector.
 func (c collector) Collect(ch chan<- prometheus.Metric) {
+	if c.scheduler != nil {
+		c.collectSnapshot(ch)
+		if len(c.requests) == 0 {
+			return
+		}
+	}
+
+	ctx := c.ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
 	start := time.Now()
-	result, errScrape := c.scrapeService.Scrape(c.parallel, c.requests)
+	result, errScrape := c.scrapeService.Scrape(ctx, c.requests)
 	if errScrape != nil {
 		logrus.WithError(errScrape).Warn("Could not scrape targets")
-		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc(fqname("error"), "Error scraping target", nil, nil), errScrape)
+		ch <- prometheus.NewInvalidMetric(c.descs.scrapeError, errScrape)
 		return
 	}
 
 	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc(fqname("scrape_duration_seconds"), "Total Pagespeed time scrape took for all targets.", nil, nil),
+		c.descs.scrapeDuration,
 		prometheus.GaugeValue,
 		float64(time.Since(start).Seconds()))
 
 	for _, scrape := range result {
-		errCollect := collect(scrape, ch)
+		errCollect := c.descs.collect(scrape, ch)
 		if errCollect != nil {
 			logrus.WithError(errCollect).WithFields(logrus.Fields{
 				"target":   scrape.Request.Url,
@@ -113,23 +367,74 @@ func (c collector) Collect(ch chan<- prometheus.Metric) {
 	}
 }
 
-func collect(scrape *ScrapeResult, ch chan<- prometheus.Metric) error {
+// collectSnapshot exports the latest results of the background scheduler
+func (c collector) collectSnapshot(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, scrape := range c.scheduler.snapshot() {
+		errCollect := c.descs.collect(scrape, ch)
+		if errCollect != nil {
+			logrus.WithError(errCollect).WithFields(logrus.Fields{
+				"target":   scrape.Request.Url,
+				"strategy": scrape.Request.Strategy,
+			}).Error("could not collect scrape target due to errors")
+			continue
+		}
+
+		// labels are valid as collecting the target succeeded
+		constLabels, _ := getConstLabels(scrape)
+		ch <- prometheus.MustNewConstMetric(c.descs.targetAge, prometheus.GaugeValue, now.Sub(scrape.Timestamp).Seconds(), targetLabelValues(constLabels)...)
+	}
+}
+
+func (d *descriptors) collect(scrape *ScrapeResult, ch chan<- prometheus.Metric) error {
 	constLabels, errLabels := getConstLabels(scrape)
 	if errLabels != nil {
 		return errLabels
 	}
+	labels := targetLabelValues(constLabels)
+
+	ch <- prometheus.MustNewConstMetric(d.targetScrapeDuration, prometheus.GaugeValue, scrape.Duration.Seconds(), labels...)
+
+	if scrape.Error != nil {
+		ch <- prometheus.MustNewConstMetric(d.targetUp, prometheus.GaugeValue, 0, labels...)
+		ch <- prometheus.MustNewConstMetric(d.targetScrapeError, prometheus.GaugeValue, 1, withLabels(labels, string(classifyError(scrape.Error)))...)
+		// the scheduler and the cache keep the last successful result of a target whose refresh failed
+		if scrape.Result == nil {
+			return nil
+		}
+	} else {
+		ch <- prometheus.MustNewConstMetric(d.targetUp, prometheus.GaugeValue, 1, labels...)
+	}
+
+	var stale float64
+	if !scrape.ExpiredAt.IsZero() {
+		stale = time.Since(scrape.ExpiredAt).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(d.targetStale, prometheus.GaugeValue, stale, labels...)
 
 	r := scrape.Result
 	if r.LoadingExperience != nil {
-		collectLoadingExperience("loading_experience", r.LoadingExperience, constLabels, ch)
+		d.collectLoadingExperience(prefixLoadingExperience, r.LoadingExperience, labels, ch)
 	}
 
 	if r.OriginLoadingExperience != nil {
-		collectLoadingExperience("origin_loading_experience", r.OriginLoadingExperience, constLabels, ch)
+		d.collectLoadingExperience(prefixOriginLoadingExperience, r.OriginLoadingExperience, labels, ch)
 	}
 
-	if r.LighthouseResult != nil {
-		collectLighthouseResults("lighthouse", scrape.Request.Categories, r.LighthouseResult, constLabels, ch)
+	if r.LoadingExperienceHistory != nil {
+		d.collectHistory(prefixLoadingExperienceHistory, r.LoadingExperienceHistory, labels, ch)
+	}
+
+	if r.OriginLoadingExperienceHistory != nil {
+		d.collectHistory(prefixOriginLoadingExperienceHistory, r.OriginLoadingExperienceHistory, labels, ch)
+	}
+
+	if r.Lighthouse != nil {
+		d.collectLighthouseResults(scrape.Request.Categories, r.Lighthouse, labels, ch)
+
+		if scrape.Stats != nil {
+			d.collectRunStats(r.Lighthouse, scrape.Stats, labels, ch)
+		}
 	}
 	return nil
 }
@@ -147,88 +452,165 @@ func getConstLabels(scrape *ScrapeResult) (prometheus.Labels, error) {
 	}, nil
 }
 
-func collectLoadingExperience(prefix string, lexp *pagespeedonline.PagespeedApiLoadingExperienceV5, constLables prometheus.Labels, ch chan<- prometheus.Metric) {
+// targetLabelValues returns the label values in the order of targetLabels
+func targetLabelValues(labels prometheus.Labels) []string {
+	values := make([]string, 0, len(targetLabels))
+	for _, l := range targetLabels {
+		values = append(values, labels[l])
+	}
+	return values
+}
+
+// withLabels returns a copy of the target label values extended by the given values
+func withLabels(labels []string, values ...string) []string {
+	return append(append(make([]string, 0, len(labels)+len(values)), labels...), values...)
+}
+
+func (d *descriptors) collectLoadingExperience(prefix string, lexp *LoadingExperience, labels []string, ch chan<- prometheus.Metric) {
 	if lexp == nil {
 		return
 	}
+	descs := d.loadingExperiences[prefix]
 
 	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc(fqname(prefix, "score"), "The specified score for the loading experience (1 FAST / 0.5 AVERAGE / 0 SLOW)  ", nil, constLables),
+		descs.score,
 		prometheus.GaugeValue,
-		convertCategoryToScore(lexp.OverallCategory))
+		convertCategoryToScore(lexp.OverallCategory),
+		labels...)
 
 	for k, v := range lexp.Metrics {
-		name := strings.TrimSuffix(strings.ToLower(k), "_ms")
-
-		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(fqname(prefix, "metrics", name, "duration_seconds"), "Percentile metrics for "+strings.Replace(name, "_", " ", -1), nil, constLables),
-			prometheus.GaugeValue,
-			float64(v.Percentile)/1000)
+		m, known := descs.metrics[k]
+		if !known {
+			logrus.WithField("metric", k).Debug("unknown loading experience metric, exporting unscaled value")
+			descs.fallback.collect(v, withLabels(labels, strings.ToLower(k)), ch)
+			continue
+		}
 
+		m.collect(v, labels, ch)
 	}
 }
 
-func collectLighthouseResults(prefix string, cats []string, lhr *pagespeedonline.LighthouseResultV5, constLabels prometheus.Labels, ch chan<- prometheus.Metric) {
+// collectHistory exports the weekly CrUX metrics labeled with the weeks before the latest collection period
+func (d *descriptors) collectHistory(prefix string, h *LoadingExperienceHistory, labels []string, ch chan<- prometheus.Metric) {
+	descs := d.histories[prefix]
+	latest := len(h.PeriodEnds) - 1
+
+	for i, end := range h.PeriodEnds {
+		ch <- prometheus.MustNewConstMetric(descs.periodEnd, prometheus.GaugeValue, float64(end.Unix()), withLabels(labels, strconv.Itoa(latest-i))...)
+	}
+
+	for k, series := range h.Metrics {
+		m, known := descs.metrics[k]
+		if !known {
+			logrus.WithField("metric", k).Debug("unknown loading experience history metric")
+			continue
+		}
+
+		for i, v := range series {
+			if v == nil || i > latest {
+				continue
+			}
+			m.collect(*v, withLabels(labels, strconv.Itoa(latest-i)), ch)
+		}
+	}
+}
 
+// collect exports the percentile of a CrUX metric, its histogram as category ratios
+// and the bucket boundaries as the good/poor thresholds
+func (d cruxDescs) collect(m CrUXMetric, labels []string, ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc(fqname(prefix, "total_duration_seconds"), "The total time spent in seconds loading the page and evaluating audits.", nil, constLabels),
+		d.value,
 		prometheus.GaugeValue,
-		lhr.Timing.Total/1000) // ms -> seconds
+		m.Percentile*d.unit.scale,
+		labels...)
 
-	categories := map[string]*pagespeedonline.LighthouseCategoryV5{
-		CategoryPerformance:   lhr.Categories.Performance,
-		CategoryAccessibility: lhr.Categories.Accessibility,
-		CategoryBestPractices: lhr.Categories.BestPractices,
-		CategorySEO:           lhr.Categories.Seo,
+	buckets := m.Distributions
+	if len(buckets) != len(distributionCategories) {
+		return
 	}
 
-	for _, c := range cats {
-		if categories[c] != nil {
-			score, err := strconv.ParseFloat(fmt.Sprint(categories[c].Score), 64)
-			if err != nil {
-				logrus.WithError(err).Warn("could not parse category score")
-				continue
-			}
+	for i, b := range buckets {
+		ch <- prometheus.MustNewConstMetric(d.ratio, prometheus.GaugeValue, b.Proportion, withLabels(labels, distributionCategories[i])...)
+	}
+
+	if d.threshold == nil {
+		return
+	}
 
+	ch <- prometheus.MustNewConstMetric(d.threshold, prometheus.GaugeValue, buckets[0].Max*d.unit.scale, withLabels(labels, "good")...)
+	ch <- prometheus.MustNewConstMetric(d.threshold, prometheus.GaugeValue, buckets[1].Max*d.unit.scale, withLabels(labels, "poor")...)
+}
+
+func (d *descriptors) collectLighthouseResults(cats []string, lhr *LighthouseResult, labels []string, ch chan<- prometheus.Metric) {
+
+	ch <- prometheus.MustNewConstMetric(
+		d.lighthouseTotalDuration,
+		prometheus.GaugeValue,
+		lhr.TotalDuration/1000, // ms -> seconds
+		labels...)
+
+	for _, c := range cats {
+		if score, ok := lhr.Categories[c]; ok {
 			ch <- prometheus.MustNewConstMetric(
-				prometheus.NewDesc(fqname(prefix, "category_score"), "Lighthouse score for the specified category", []string{"category"}, constLabels),
+				d.lighthouseCategoryScore,
 				prometheus.GaugeValue,
 				score,
-				c)
+				withLabels(labels, c)...)
 		}
 	}
 
 	for k, v := range lhr.Audits {
-		if timeAuditMetrics[k] {
-			displayValue := strings.Replace(v.DisplayValue, "\u00a0", "", -1)
-			displayValue = strings.Replace(displayValue, ",", "", -1)
-			if !timeUnitRe.MatchString(displayValue) {
-				displayValue = displayValue + "s"
-			}
-
-			if duration, errDuration := time.ParseDuration(timeValueRe.FindString(displayValue)); errDuration == nil {
+		if v.NumericUnit != "" {
+			if u, ok := lighthouseUnits[v.NumericUnit]; ok {
 				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(fqname(prefix, k, "duration_seconds"), v.Description, nil, constLabels),
+					d.lighthouseAuditNumeric[v.NumericUnit],
 					prometheus.GaugeValue,
-					duration.Seconds())
+					v.NumericValue*u.scale,
+					withLabels(labels, k)...)
 			} else {
-				logrus.WithError(errDuration).Warn("could not parse time audit metric duration for metric: ", k)
+				logrus.WithField("audit", k).Debug("unknown numeric unit for audit: ", v.NumericUnit)
 			}
 		}
 
-		score, err := strconv.ParseFloat(fmt.Sprint(v.Score), 64)
-		if err != nil {
+		if v.Score == nil {
 			continue
 		}
 
 		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(fqname(prefix, "audit_score"), "Lighthouse audit scores", []string{"audit"}, constLabels),
+			d.lighthouseAuditScore,
 			prometheus.GaugeValue,
-			score,
-			k)
+			*v.Score,
+			withLabels(labels, k)...)
 	}
 }
 
+// collectRunStats exports the spread of the lighthouse values over the runs of a target,
+// the medians are exported by collectLighthouseResults
+func (d *descriptors) collectRunStats(lhr *LighthouseResult, stats *RunStats, labels []string, ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(d.lighthouseRuns, prometheus.GaugeValue, float64(stats.Count), labels...)
+
+	for c, s := range stats.Categories {
+		d.lighthouseCategoryScoreStats.collect(s, 1, withLabels(labels, c), ch)
+	}
+
+	for k, s := range stats.Audits {
+		d.lighthouseAuditScoreStats.collect(s, 1, withLabels(labels, k), ch)
+	}
+
+	for k, s := range stats.Numeric {
+		numericUnit := lhr.Audits[k].NumericUnit
+		if u, ok := lighthouseUnits[numericUnit]; ok {
+			d.lighthouseAuditNumericStats[numericUnit].collect(s, u.scale, withLabels(labels, k), ch)
+		}
+	}
+}
+
+func (d runStatsDescs) collect(s Stats, scale float64, labels []string, ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(d.min, prometheus.GaugeValue, s.Min*scale, labels...)
+	ch <- prometheus.MustNewConstMetric(d.max, prometheus.GaugeValue, s.Max*scale, labels...)
+	ch <- prometheus.MustNewConstMetric(d.stddev, prometheus.GaugeValue, s.StdDev*scale, labels...)
+}
+
 func convertCategoryToScore(category string) float64 {
 	switch category {
 	case "AVERAGE":
@@ -1,14 +1,21 @@
 package collector
 
 import (
+	"context"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
+	"google.golang.org/api/pagespeedonline/v5"
 )
 
 func loadTestEnv() {
@@ -138,7 +145,7 @@ func Test_CollectorIntegration(t *testing.T) {
 		config.CredentialsFile = cf
 	}
 
-	coll, err := newCollector(config)
+	coll, err := newCollector(config, &factory{})
 	if err != nil {
 		t.Fatalf("failed to create collector: %v", err)
 	}
@@ -190,3 +197,272 @@ func containsSubstring(s, substr string) bool {
 	}
 	return false
 }
+
+// collectFunc adapts a collect function to a prometheus.Collector for testutil
+type collectFunc func(ch chan<- prometheus.Metric)
+
+func (f collectFunc) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(f, ch)
+}
+
+func (f collectFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
+func Test_collectLoadingExperience(t *testing.T) {
+	lexp := &pagespeedonline.PagespeedApiLoadingExperienceV5{
+		OverallCategory: "FAST",
+		Metrics: map[string]pagespeedonline.UserPageLoadMetricV5{
+			"LARGEST_CONTENTFUL_PAINT_MS": {
+				Percentile: 1278,
+				Distributions: []*pagespeedonline.Bucket{
+					{Min: 0, Max: 2500, Proportion: 0.9389},
+					{Min: 2500, Max: 4000, Proportion: 0.0371},
+					{Min: 4000, Proportion: 0.024},
+				},
+			},
+			"CUMULATIVE_LAYOUT_SHIFT_SCORE": {
+				Percentile: 5,
+				Distributions: []*pagespeedonline.Bucket{
+					{Min: 0, Max: 10, Proportion: 0.9994},
+					{Min: 10, Max: 25, Proportion: 0.0004},
+					{Min: 25, Proportion: 0.0002},
+				},
+			},
+			"SOME_FUTURE_METRIC": {
+				Percentile: 42,
+			},
+		},
+	}
+	labels := []string{"https://host", "/", "mobile"}
+
+	coll := collectFunc(func(ch chan<- prometheus.Metric) {
+		newDescriptors().collectLoadingExperience(prefixLoadingExperience, newLoadingExperience(lexp), labels, ch)
+	})
+
+	expected := `
+# HELP pagespeed_loading_experience_metrics_largest_contentful_paint_category_ratio Proportion of page loads in the specified category
+# TYPE pagespeed_loading_experience_metrics_largest_contentful_paint_category_ratio gauge
+pagespeed_loading_experience_metrics_largest_contentful_paint_category_ratio{category="average",host="https://host",path="/",strategy="mobile"} 0.0371
+pagespeed_loading_experience_metrics_largest_contentful_paint_category_ratio{category="fast",host="https://host",path="/",strategy="mobile"} 0.9389
+pagespeed_loading_experience_metrics_largest_contentful_paint_category_ratio{category="slow",host="https://host",path="/",strategy="mobile"} 0.024
+# HELP pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds Percentile metrics for largest contentful paint
+# TYPE pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds gauge
+pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds{host="https://host",path="/",strategy="mobile"} 1.278
+# HELP pagespeed_loading_experience_metrics_largest_contentful_paint_threshold_duration_seconds Threshold between the specified categories
+# TYPE pagespeed_loading_experience_metrics_largest_contentful_paint_threshold_duration_seconds gauge
+pagespeed_loading_experience_metrics_largest_contentful_paint_threshold_duration_seconds{host="https://host",path="/",strategy="mobile",threshold="good"} 2.5
+pagespeed_loading_experience_metrics_largest_contentful_paint_threshold_duration_seconds{host="https://host",path="/",strategy="mobile",threshold="poor"} 4
+# HELP pagespeed_loading_experience_metrics_cumulative_layout_shift_score Percentile metrics for cumulative layout shift score
+# TYPE pagespeed_loading_experience_metrics_cumulative_layout_shift_score gauge
+pagespeed_loading_experience_metrics_cumulative_layout_shift_score{host="https://host",path="/",strategy="mobile"} 0.05
+# HELP pagespeed_loading_experience_metrics_cumulative_layout_shift_score_threshold Threshold between the specified categories
+# TYPE pagespeed_loading_experience_metrics_cumulative_layout_shift_score_threshold gauge
+pagespeed_loading_experience_metrics_cumulative_layout_shift_score_threshold{host="https://host",path="/",strategy="mobile",threshold="good"} 0.1
+pagespeed_loading_experience_metrics_cumulative_layout_shift_score_threshold{host="https://host",path="/",strategy="mobile",threshold="poor"} 0.25
+# HELP pagespeed_loading_experience_metrics_value Percentile metrics for loading experience metrics without a known unit
+# TYPE pagespeed_loading_experience_metrics_value gauge
+pagespeed_loading_experience_metrics_value{host="https://host",metric="some_future_metric",path="/",strategy="mobile"} 42
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected),
+		"pagespeed_loading_experience_metrics_largest_contentful_paint_category_ratio",
+		"pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds",
+		"pagespeed_loading_experience_metrics_largest_contentful_paint_threshold_duration_seconds",
+		"pagespeed_loading_experience_metrics_cumulative_layout_shift_score",
+		"pagespeed_loading_experience_metrics_cumulative_layout_shift_score_threshold",
+		"pagespeed_loading_experience_metrics_value",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_collectLighthouseResults(t *testing.T) {
+	lhr := &pagespeedonline.LighthouseResultV5{
+		Timing:     &pagespeedonline.Timing{Total: 12500},
+		Categories: &pagespeedonline.Categories{Performance: &pagespeedonline.LighthouseCategoryV5{Score: 0.91}},
+		Audits: map[string]pagespeedonline.LighthouseAuditResultV5{
+			"first-contentful-paint":  {DisplayValue: "1,2 s", NumericValue: 1234.5, NumericUnit: "millisecond", Score: 0.98},
+			"total-byte-weight":       {NumericValue: 524288, NumericUnit: "byte", Score: 1},
+			"cumulative-layout-shift": {NumericValue: 0.012, NumericUnit: "unitless", Score: 1},
+			"dom-size":                {NumericValue: 0, NumericUnit: "element", Score: 1},
+			"viewport":                {Score: 1},
+		},
+	}
+	labels := []string{"https://host", "/", "mobile"}
+
+	coll := collectFunc(func(ch chan<- prometheus.Metric) {
+		newDescriptors().collectLighthouseResults([]string{CategoryPerformance}, newLighthouseResult(lhr), labels, ch)
+	})
+
+	expected := `
+# HELP pagespeed_lighthouse_audit_bytes Lighthouse audit numeric values
+# TYPE pagespeed_lighthouse_audit_bytes gauge
+pagespeed_lighthouse_audit_bytes{audit="total-byte-weight",host="https://host",path="/",strategy="mobile"} 524288
+# HELP pagespeed_lighthouse_audit_duration_seconds Lighthouse audit numeric values
+# TYPE pagespeed_lighthouse_audit_duration_seconds gauge
+pagespeed_lighthouse_audit_duration_seconds{audit="first-contentful-paint",host="https://host",path="/",strategy="mobile"} 1.2345
+# HELP pagespeed_lighthouse_audit_elements Lighthouse audit numeric values
+# TYPE pagespeed_lighthouse_audit_elements gauge
+pagespeed_lighthouse_audit_elements{audit="dom-size",host="https://host",path="/",strategy="mobile"} 0
+# HELP pagespeed_lighthouse_audit_value Lighthouse audit numeric values
+# TYPE pagespeed_lighthouse_audit_value gauge
+pagespeed_lighthouse_audit_value{audit="cumulative-layout-shift",host="https://host",path="/",strategy="mobile"} 0.012
+# HELP pagespeed_lighthouse_category_score Lighthouse score for the specified category
+# TYPE pagespeed_lighthouse_category_score gauge
+pagespeed_lighthouse_category_score{category="performance",host="https://host",path="/",strategy="mobile"} 0.91
+# HELP pagespeed_lighthouse_total_duration_seconds The total time spent in seconds loading the page and evaluating audits.
+# TYPE pagespeed_lighthouse_total_duration_seconds gauge
+pagespeed_lighthouse_total_duration_seconds{host="https://host",path="/",strategy="mobile"} 12.5
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected),
+		"pagespeed_lighthouse_audit_bytes",
+		"pagespeed_lighthouse_audit_duration_seconds",
+		"pagespeed_lighthouse_audit_elements",
+		"pagespeed_lighthouse_audit_value",
+		"pagespeed_lighthouse_category_score",
+		"pagespeed_lighthouse_total_duration_seconds",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_collectRunStats(t *testing.T) {
+	lhr := &pagespeedonline.LighthouseResultV5{
+		Audits: map[string]pagespeedonline.LighthouseAuditResultV5{
+			"first-contentful-paint": {NumericValue: 1500, NumericUnit: "millisecond", Score: 0.9},
+		},
+	}
+	stats := &RunStats{
+		Count:      3,
+		Categories: map[string]Stats{CategoryPerformance: {Median: 0.7, Min: 0.5, Max: 0.9, StdDev: 0.1}},
+		Audits:     map[string]Stats{"first-contentful-paint": {Median: 0.9, Min: 0.8, Max: 1, StdDev: 0.05}},
+		Numeric:    map[string]Stats{"first-contentful-paint": {Median: 1500, Min: 1000, Max: 2500, StdDev: 500}},
+	}
+	labels := []string{"https://host", "/", "mobile"}
+
+	coll := collectFunc(func(ch chan<- prometheus.Metric) {
+		newDescriptors().collectRunStats(newLighthouseResult(lhr), stats, labels, ch)
+	})
+
+	expected := `
+# HELP pagespeed_lighthouse_audit_duration_seconds_max Lighthouse audit numeric values, maximum of all runs
+# TYPE pagespeed_lighthouse_audit_duration_seconds_max gauge
+pagespeed_lighthouse_audit_duration_seconds_max{audit="first-contentful-paint",host="https://host",path="/",strategy="mobile"} 2.5
+# HELP pagespeed_lighthouse_audit_duration_seconds_stddev Lighthouse audit numeric values, standard deviation of all runs
+# TYPE pagespeed_lighthouse_audit_duration_seconds_stddev gauge
+pagespeed_lighthouse_audit_duration_seconds_stddev{audit="first-contentful-paint",host="https://host",path="/",strategy="mobile"} 0.5
+# HELP pagespeed_lighthouse_audit_score_min Lighthouse audit scores, minimum of all runs
+# TYPE pagespeed_lighthouse_audit_score_min gauge
+pagespeed_lighthouse_audit_score_min{audit="first-contentful-paint",host="https://host",path="/",strategy="mobile"} 0.8
+# HELP pagespeed_lighthouse_category_score_stddev Lighthouse score for the specified category, standard deviation of all runs
+# TYPE pagespeed_lighthouse_category_score_stddev gauge
+pagespeed_lighthouse_category_score_stddev{category="performance",host="https://host",path="/",strategy="mobile"} 0.1
+# HELP pagespeed_lighthouse_runs Number of lighthouse runs aggregated into the median of the lighthouse metrics
+# TYPE pagespeed_lighthouse_runs gauge
+pagespeed_lighthouse_runs{host="https://host",path="/",strategy="mobile"} 3
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected),
+		"pagespeed_lighthouse_audit_duration_seconds_max",
+		"pagespeed_lighthouse_audit_duration_seconds_stddev",
+		"pagespeed_lighthouse_audit_score_min",
+		"pagespeed_lighthouse_category_score_stddev",
+		"pagespeed_lighthouse_runs",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+// fakeScrapeService returns the configured results for every scrape
+type fakeScrapeService struct {
+	results []*ScrapeResult
+	err     error
+}
+
+func (f fakeScrapeService) Scrape(ctx context.Context, requests []ScrapeRequest) ([]*ScrapeResult, error) {
+	return f.results, f.err
+}
+
+func Test_collectorRegistration(t *testing.T) {
+	newTestCollector := func() prometheus.Collector {
+		return collector{
+			scrapeService: fakeScrapeService{results: []*ScrapeResult{{
+				Request: ScrapeRequest{Url: "https://host/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}},
+				Result: newResult(&pagespeedonline.PagespeedApiPagespeedResponseV5{
+					LoadingExperience: &pagespeedonline.PagespeedApiLoadingExperienceV5{
+						OverallCategory: "FAST",
+						Metrics: map[string]pagespeedonline.UserPageLoadMetricV5{
+							"LARGEST_CONTENTFUL_PAINT_MS": {Percentile: 1278},
+							"SOME_FUTURE_METRIC":          {Percentile: 42},
+						},
+					},
+					LighthouseResult: &pagespeedonline.LighthouseResultV5{
+						Timing:     &pagespeedonline.Timing{Total: 12500},
+						Categories: &pagespeedonline.Categories{Performance: &pagespeedonline.LighthouseCategoryV5{Score: 0.91}},
+						Audits: map[string]pagespeedonline.LighthouseAuditResultV5{
+							"first-contentful-paint": {NumericValue: 1234.5, NumericUnit: "millisecond", Score: 0.98},
+						},
+					},
+				}),
+			}}},
+			descs: newDescriptors(),
+		}
+	}
+
+	// A pedantic registry fails gathering metrics which were not announced by Describe
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(newTestCollector()); err != nil {
+		t.Fatalf("could not register collector: %v", err)
+	}
+
+	if _, err := registry.Gather(); err != nil {
+		t.Errorf("collected metrics do not match the described ones: %v", err)
+	}
+
+	if err := registry.Register(newTestCollector()); err == nil {
+		t.Error("registering a second collector should fail")
+	}
+
+	conflicting := prometheus.NewGauge(prometheus.GaugeOpts{Name: "pagespeed_lighthouse_category_score", Help: "conflict"})
+	if err := registry.Register(conflicting); err == nil {
+		t.Error("registering a conflicting metric should fail")
+	}
+}
+
+func Test_collectorTargetStatus(t *testing.T) {
+	coll := collector{
+		scrapeService: fakeScrapeService{results: []*ScrapeResult{
+			{
+				Request:  ScrapeRequest{Url: "https://host/ok", Strategy: StrategyMobile},
+				Result:   &Result{},
+				Duration: 1500 * time.Millisecond,
+			},
+			{
+				Request:  ScrapeRequest{Url: "https://host/quota", Strategy: StrategyDesktop},
+				Duration: 250 * time.Millisecond,
+				Error:    &googleapi.Error{Code: http.StatusTooManyRequests},
+			},
+		}},
+		descs: newDescriptors(),
+	}
+
+	expected := `
+# HELP pagespeed_scrape_target_duration_seconds Time the last scrape of the target took
+# TYPE pagespeed_scrape_target_duration_seconds gauge
+pagespeed_scrape_target_duration_seconds{host="https://host",path="/ok",strategy="mobile"} 1.5
+pagespeed_scrape_target_duration_seconds{host="https://host",path="/quota",strategy="desktop"} 0.25
+# HELP pagespeed_scrape_target_error Set to 1 with the error class if the last scrape of the target failed
+# TYPE pagespeed_scrape_target_error gauge
+pagespeed_scrape_target_error{class="quota",host="https://host",path="/quota",strategy="desktop"} 1
+# HELP pagespeed_up Whether the last scrape of the target was successful (1) or not (0)
+# TYPE pagespeed_up gauge
+pagespeed_up{host="https://host",path="/ok",strategy="mobile"} 1
+pagespeed_up{host="https://host",path="/quota",strategy="desktop"} 0
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected),
+		"pagespeed_scrape_target_duration_seconds",
+		"pagespeed_scrape_target_error",
+		"pagespeed_up",
+	); err != nil {
+		t.Error(err)
+	}
+}
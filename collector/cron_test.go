@@ -0,0 +1,64 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseCronSchedule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 8-18 * * 1-5", false},
+		{"0 3 * * 7", false},
+		{"0,30 * 1,15 * *", false},
+		{"@daily", false},
+		{"* * * *", true},
+		{"60 * * * *", true},
+		{"*/0 * * * *", true},
+		{"5-1 * * * *", true},
+		{"pancake * * * *", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := parseCronSchedule(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseCronSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_cronScheduleNext(t *testing.T) {
+	// a wednesday
+	from := time.Date(2024, time.May, 15, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.May, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.May, 15, 10, 15, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.May, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2024, time.May, 15, 11, 0, 0, 0, time.UTC)},
+		{"0 3 * * 0", time.Date(2024, time.May, 19, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2024, time.May, 19, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 5", time.Date(2024, time.May, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := parseCronSchedule(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(from); !got.Equal(tt.want) {
+				t.Errorf("next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
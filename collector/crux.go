@@ -0,0 +1,303 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// DefaultCrUXEndpoint is the base URL of the Chrome UX Report API
+const DefaultCrUXEndpoint = "https://chromeuxreport.googleapis.com"
+
+// cruxFormFactors maps the strategies to the form factors of CrUX records
+var cruxFormFactors = map[Strategy]string{
+	StrategyMobile:  "PHONE",
+	StrategyDesktop: "DESKTOP",
+}
+
+// cruxAPIMetric maps a metric of the CrUX API to the key and units of the PageSpeed Insights API
+type cruxAPIMetric struct {
+	key   string
+	scale float64
+}
+
+// cruxAPIMetrics are the known metrics of the CrUX API. Other metrics with a 75th percentile
+// are exported with their upper case name through the generic metric families.
+var cruxAPIMetrics = map[string]cruxAPIMetric{
+	"cumulative_layout_shift":         {"CUMULATIVE_LAYOUT_SHIFT_SCORE", 100},
+	"experimental_time_to_first_byte": {"EXPERIMENTAL_TIME_TO_FIRST_BYTE", 1},
+	"first_contentful_paint":          {"FIRST_CONTENTFUL_PAINT_MS", 1},
+	"first_input_delay":               {"FIRST_INPUT_DELAY_MS", 1},
+	"interaction_to_next_paint":       {"INTERACTION_TO_NEXT_PAINT", 1},
+	"largest_contentful_paint":        {"LARGEST_CONTENTFUL_PAINT_MS", 1},
+}
+
+// coreWebVitals are the metric keys the overall category of a loading experience is based on
+var coreWebVitals = []string{"LARGEST_CONTENTFUL_PAINT_MS", "INTERACTION_TO_NEXT_PAINT", "CUMULATIVE_LAYOUT_SHIFT_SCORE"}
+
+// cruxQuery identifies a CrUX record of either an URL or an origin
+type cruxQuery struct {
+	URL        string `json:"url,omitempty"`
+	Origin     string `json:"origin,omitempty"`
+	FormFactor string `json:"formFactor,omitempty"`
+}
+
+// cruxNumber is a value of the CrUX API, which encodes fractional values like layout shifts as strings.
+// Values missing in a time series are NaN.
+type cruxNumber float64
+
+func (n *cruxNumber) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "null" {
+		*n = cruxNumber(math.NaN())
+		return nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid CrUX value %s", b)
+	}
+	*n = cruxNumber(value)
+	return nil
+}
+
+type cruxRecordResponse struct {
+	Record struct {
+		Metrics map[string]struct {
+			Histogram []struct {
+				Start   cruxNumber `json:"start"`
+				End     cruxNumber `json:"end"`
+				Density float64    `json:"density"`
+			} `json:"histogram"`
+			Percentiles *struct {
+				P75 cruxNumber `json:"p75"`
+			} `json:"percentiles"`
+		} `json:"metrics"`
+	} `json:"record"`
+}
+
+// cruxClient calls the Chrome UX Report API
+type cruxClient struct {
+	endpoint string
+	client   *http.Client // authenticates requests with the API key
+}
+
+// queryRecord returns the loading experience of the last 28 days, nil if CrUX has no data for the query
+func (c *cruxClient) queryRecord(ctx context.Context, query cruxQuery) (*LoadingExperience, error) {
+	var response cruxRecordResponse
+	if err := c.post(ctx, "queryRecord", query, &response); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	l := &LoadingExperience{Metrics: make(map[string]CrUXMetric, len(response.Record.Metrics))}
+	for name, m := range response.Record.Metrics {
+		if m.Percentiles == nil {
+			continue
+		}
+		known, ok := cruxAPIMetrics[name]
+		if !ok {
+			known = cruxAPIMetric{key: strings.ToUpper(name), scale: 1}
+		}
+
+		metric := CrUXMetric{Percentile: float64(m.Percentiles.P75) * known.scale}
+		for _, b := range m.Histogram {
+			metric.Distributions = append(metric.Distributions, Bucket{
+				Min:        float64(b.Start) * known.scale,
+				Max:        float64(b.End) * known.scale,
+				Proportion: b.Density,
+			})
+		}
+		l.Metrics[known.key] = metric
+	}
+	l.OverallCategory = overallCategory(l.Metrics)
+	return l, nil
+}
+
+// post calls a method of the records resource and decodes its response
+func (c *cruxClient) post(ctx context.Context, method string, query cruxQuery, v interface{}) error {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.endpoint, "/")+"/v1/records:"+method, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "could not create CrUX request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "could not parse CrUX response")
+}
+
+// overallCategory rates a loading experience by its slowest core web vital like the
+// PageSpeed Insights API, comparing the 75th percentiles to the histogram boundaries
+func overallCategory(metrics map[string]CrUXMetric) string {
+	category := "NONE"
+	for _, k := range coreWebVitals {
+		m, ok := metrics[k]
+		if !ok || len(m.Distributions) != len(distributionCategories) {
+			continue
+		}
+		switch {
+		case m.Percentile > m.Distributions[1].Max:
+			return "SLOW"
+		case m.Percentile > m.Distributions[0].Max:
+			category = "AVERAGE"
+		case category == "NONE":
+			category = "FAST"
+		}
+	}
+	return category
+}
+
+// cruxBackend looks up the field data of the page and its origin in the CrUX API without running lighthouse
+type cruxBackend struct {
+	client  *cruxClient
+	records *cruxRecords[*LoadingExperience] // nil looks up the records on every run
+}
+
+func (b *cruxBackend) run(ctx context.Context, request ScrapeRequest) (*Result, error) {
+	target, err := url.Parse(request.Url)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid target url")
+	}
+	formFactor := cruxFormFactors[request.Strategy]
+
+	page, err := b.lookup(ctx, cruxQuery{URL: request.Url, FormFactor: formFactor})
+	if err != nil {
+		return nil, err
+	}
+
+	origin, err := b.lookup(ctx, cruxQuery{Origin: target.Scheme + "://" + target.Host, FormFactor: formFactor})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{LoadingExperience: page, OriginLoadingExperience: origin}, nil
+}
+
+// lookup returns the loading experience of the query, reusing records looked up recently
+func (b *cruxBackend) lookup(ctx context.Context, query cruxQuery) (*LoadingExperience, error) {
+	if l, ok := b.records.get(query); ok {
+		return l, nil
+	}
+
+	l, err := b.client.queryRecord(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	b.records.set(query, l)
+	return l, nil
+}
+
+// cruxRecords keeps looked up CrUX records for an interval. CrUX data is updated daily,
+// so field data can be refreshed less often than the targets are scraped.
+type cruxRecords[T any] struct {
+	interval time.Duration
+	mu       sync.Mutex
+	records  map[cruxQuery]cruxRecord[T]
+}
+
+type cruxRecord[T any] struct {
+	value     T // nil if CrUX has no data
+	expiresAt time.Time
+}
+
+func newCrUXRecords[T any](interval time.Duration) *cruxRecords[T] {
+	if interval <= 0 {
+		return nil
+	}
+	return &cruxRecords[T]{interval: interval, records: map[cruxQuery]cruxRecord[T]{}}
+}
+
+func (r *cruxRecords[T]) get(query cruxQuery) (value T, ok bool) {
+	if r == nil {
+		return value, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[query]
+	if !ok || time.Now().After(record.expiresAt) {
+		return value, false
+	}
+	return record.value, true
+}
+
+func (r *cruxRecords[T]) set(query cruxQuery, value T) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// drop expired records, e.g. of probed targets which are not scraped anymore
+	now := time.Now()
+	for q, record := range r.records {
+		if now.After(record.expiresAt) {
+			delete(r.records, q)
+		}
+	}
+	r.records[query] = cruxRecord[T]{value: value, expiresAt: now.Add(r.interval)}
+}
+
+// fieldDataBackend adds the field data of the CrUX API to the results of a lab backend
+type fieldDataBackend struct {
+	lab   backend
+	field *cruxBackend
+}
+
+func (b *fieldDataBackend) run(ctx context.Context, request ScrapeRequest) (*Result, error) {
+	result, err := b.lab.run(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// field data is optional, the lab data is exported without it if CrUX has none or the lookup fails
+	target, err := url.Parse(request.Url)
+	if err != nil {
+		return result, nil
+	}
+	formFactor := cruxFormFactors[request.Strategy]
+
+	result.LoadingExperience = b.lookup(ctx, request, cruxQuery{URL: request.Url, FormFactor: formFactor})
+	result.OriginLoadingExperience = b.lookup(ctx, request, cruxQuery{Origin: target.Scheme + "://" + target.Host, FormFactor: formFactor})
+	return result, nil
+}
+
+// lookup returns the loading experience of the query, nil if the lookup failed
+func (b *fieldDataBackend) lookup(ctx context.Context, request ScrapeRequest, query cruxQuery) *LoadingExperience {
+	l, err := b.field.lookup(ctx, query)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"target":   request.Url,
+			"strategy": request.Strategy,
+			"origin":   query.Origin != "",
+		}).Warn("could not look up CrUX data, exporting the lab data only")
+		return nil
+	}
+	return l
+}
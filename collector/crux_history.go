@@ -0,0 +1,147 @@
+package collector
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+type cruxHistoryResponse struct {
+	Record struct {
+		Metrics map[string]struct {
+			HistogramTimeseries []struct {
+				Start     cruxNumber   `json:"start"`
+				End       cruxNumber   `json:"end"`
+				Densities []cruxNumber `json:"densities"`
+			} `json:"histogramTimeseries"`
+			PercentilesTimeseries *struct {
+				P75s []cruxNumber `json:"p75s"`
+			} `json:"percentilesTimeseries"`
+		} `json:"metrics"`
+		CollectionPeriods []struct {
+			LastDate cruxDate `json:"lastDate"`
+		} `json:"collectionPeriods"`
+	} `json:"record"`
+}
+
+// cruxDate is a calendar date of the CrUX API
+type cruxDate struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Day   int `json:"day"`
+}
+
+func (d cruxDate) time() time.Time {
+	return time.Date(d.Year, time.Month(d.Month), d.Day, 0, 0, 0, 0, time.UTC)
+}
+
+// queryHistoryRecord returns the loading experience of the weekly collection periods, nil if CrUX has no data for the query
+func (c *cruxClient) queryHistoryRecord(ctx context.Context, query cruxQuery) (*LoadingExperienceHistory, error) {
+	var response cruxHistoryResponse
+	if err := c.post(ctx, "queryHistoryRecord", query, &response); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	periods := len(response.Record.CollectionPeriods)
+	h := &LoadingExperienceHistory{
+		PeriodEnds: make([]time.Time, 0, periods),
+		Metrics:    make(map[string][]*CrUXMetric, len(response.Record.Metrics)),
+	}
+	for _, p := range response.Record.CollectionPeriods {
+		h.PeriodEnds = append(h.PeriodEnds, p.LastDate.time())
+	}
+
+	for name, m := range response.Record.Metrics {
+		known, ok := cruxAPIMetrics[name]
+		if !ok || m.PercentilesTimeseries == nil {
+			continue
+		}
+
+		series := make([]*CrUXMetric, periods)
+		for i := range series {
+			if i >= len(m.PercentilesTimeseries.P75s) || math.IsNaN(float64(m.PercentilesTimeseries.P75s[i])) {
+				continue
+			}
+
+			metric := &CrUXMetric{Percentile: float64(m.PercentilesTimeseries.P75s[i]) * known.scale}
+			for _, b := range m.HistogramTimeseries {
+				if i >= len(b.Densities) || math.IsNaN(float64(b.Densities[i])) {
+					metric.Distributions = nil
+					break
+				}
+				metric.Distributions = append(metric.Distributions, Bucket{
+					Min:        float64(b.Start) * known.scale,
+					Max:        float64(b.End) * known.scale,
+					Proportion: float64(b.Densities[i]),
+				})
+			}
+			series[i] = metric
+		}
+		h.Metrics[known.key] = series
+	}
+	return h, nil
+}
+
+// historyBackend adds the weekly field data of the CrUX History API to the results of another backend
+type historyBackend struct {
+	next    backend
+	client  *cruxClient
+	records *cruxRecords[*LoadingExperienceHistory] // nil looks up the records on every run
+}
+
+func (b *historyBackend) run(ctx context.Context, request ScrapeRequest) (*Result, error) {
+	result, err := b.next.run(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// the history only adds trends, so the result of the next backend is kept if it can't be looked up,
+	// e.g. if the History API is not enabled for the key
+	target, err := url.Parse(request.Url)
+	if err != nil {
+		return result, nil
+	}
+	formFactor := cruxFormFactors[request.Strategy]
+
+	result.LoadingExperienceHistory = b.lookupLogged(ctx, request, cruxQuery{URL: request.Url, FormFactor: formFactor})
+	result.OriginLoadingExperienceHistory = b.lookupLogged(ctx, request, cruxQuery{Origin: target.Scheme + "://" + target.Host, FormFactor: formFactor})
+	return result, nil
+}
+
+// lookupLogged returns the history of the query, nil if the lookup failed
+func (b *historyBackend) lookupLogged(ctx context.Context, request ScrapeRequest, query cruxQuery) *LoadingExperienceHistory {
+	h, err := b.lookup(ctx, query)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"target":   request.Url,
+			"strategy": request.Strategy,
+			"origin":   query.Origin != "",
+		}).Warn("could not look up CrUX history, exporting the result without it")
+		return nil
+	}
+	return h
+}
+
+// lookup returns the history of the query, reusing records looked up recently
+func (b *historyBackend) lookup(ctx context.Context, query cruxQuery) (*LoadingExperienceHistory, error) {
+	if h, ok := b.records.get(query); ok {
+		return h, nil
+	}
+
+	h, err := b.client.queryHistoryRecord(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	b.records.set(query, h)
+	return h, nil
+}
@@ -0,0 +1,179 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var testCrUXHistoryFixtures = map[cruxQuery]string{
+	{URL: "https://www.example.com/", FormFactor: "PHONE"}:   "crux-history-url.json",
+	{Origin: "https://www.example.com", FormFactor: "PHONE"}: "crux-history-origin.json",
+}
+
+func Test_cruxClient_queryHistoryRecord(t *testing.T) {
+	server, _ := newCrUXServer(t, "queryHistoryRecord", testCrUXHistoryFixtures)
+	client := newTestCrUXClient(t, server.URL)
+
+	h, err := client.queryHistoryRecord(context.Background(), cruxQuery{URL: "https://www.example.com/", FormFactor: "PHONE"})
+	if err != nil {
+		t.Fatalf("queryHistoryRecord should not throw an error: %v", err)
+	}
+
+	wantEnds := []time.Time{
+		time.Date(2024, 10, 21, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 10, 28, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 11, 4, 0, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(h.PeriodEnds, wantEnds) {
+		t.Errorf("period ends = %v, want %v", h.PeriodEnds, wantEnds)
+	}
+
+	wantCLS := []*CrUXMetric{
+		{Percentile: 8, Distributions: []Bucket{{Min: 0, Max: 10, Proportion: 0.8512}, {Min: 10, Max: 25, Proportion: 0.0913}, {Min: 25, Proportion: 0.0575}}},
+		nil,
+		{Percentile: 5, Distributions: []Bucket{{Min: 0, Max: 10, Proportion: 0.8712}, {Min: 10, Max: 25, Proportion: 0.0813}, {Min: 25, Proportion: 0.0475}}},
+	}
+	if cls := h.Metrics["CUMULATIVE_LAYOUT_SHIFT_SCORE"]; !reflect.DeepEqual(cls, wantCLS) {
+		t.Errorf("layout shift = %v, want %v", cls, wantCLS)
+	}
+
+	lcp := h.Metrics["LARGEST_CONTENTFUL_PAINT_MS"]
+	if len(lcp) != 3 || lcp[0].Percentile != 2912 || lcp[2].Percentile != 2612 || lcp[2].Distributions[0].Proportion != 0.7511 {
+		t.Errorf("largest contentful paint = %v, want the p75 and densities of every period", lcp)
+	}
+
+	for _, k := range []string{"ROUND_TRIP_TIME", "NAVIGATION_TYPES"} {
+		if _, ok := h.Metrics[k]; ok {
+			t.Errorf("unknown metric %s should be skipped", k)
+		}
+	}
+
+	missing, err := client.queryHistoryRecord(context.Background(), cruxQuery{URL: "https://www.example.com/", FormFactor: "DESKTOP"})
+	if err != nil || missing != nil {
+		t.Errorf("queryHistoryRecord() = %v, %v, want no record and no error without CrUX data", missing, err)
+	}
+}
+
+func Test_historyBackend(t *testing.T) {
+	server, calls := newCrUXServer(t, "queryHistoryRecord", testCrUXHistoryFixtures)
+	var runs int32
+	b := &historyBackend{
+		next: backendFunc(func(ctx context.Context, request ScrapeRequest) (*Result, error) {
+			atomic.AddInt32(&runs, 1)
+			return &Result{Lighthouse: &LighthouseResult{TotalDuration: 12500}}, nil
+		}),
+		client:  newTestCrUXClient(t, server.URL),
+		records: newCrUXRecords[*LoadingExperienceHistory](time.Hour),
+	}
+
+	request := ScrapeRequest{Url: "https://www.example.com/", Strategy: StrategyMobile}
+	for i := 0; i < 2; i++ {
+		result, err := b.run(context.Background(), request)
+		if err != nil {
+			t.Fatalf("run() should not throw an error: %v", err)
+		}
+		if result.Lighthouse == nil || result.LoadingExperienceHistory == nil || result.OriginLoadingExperienceHistory == nil {
+			t.Fatalf("run() = %+v, want the result of the next backend with the history of the page and origin", result)
+		}
+	}
+	if *calls != 2 || runs != 2 {
+		t.Errorf("CrUX History API was called %d times and the next backend %d times, want 2 calls reusing the records and 2 runs", *calls, runs)
+	}
+
+	// the lookup of the page fails, the origin has a history
+	origin, err := os.ReadFile(filepath.Join("testdata", "crux-history-origin.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	denying := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query cruxQuery
+		_ = json.NewDecoder(r.Body).Decode(&query)
+		if query.URL != "" {
+			http.Error(w, `{"error":{"code":403,"message":"referer blocked","status":"PERMISSION_DENIED"}}`, http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write(origin)
+	}))
+	defer denying.Close()
+
+	b.client.endpoint = denying.URL
+	result, err := b.run(context.Background(), ScrapeRequest{Url: "https://www.example.com/new", Strategy: StrategyMobile})
+	if err != nil {
+		t.Fatalf("run() should not fail if the CrUX History lookup fails: %v", err)
+	}
+	if result.LoadingExperienceHistory != nil || result.OriginLoadingExperienceHistory == nil {
+		t.Errorf("run() = %+v, want the history of the origin only", result)
+	}
+
+	b.client.endpoint = server.URL + "/unknown"
+	result, err = b.run(context.Background(), ScrapeRequest{Url: "https://www.example.com/other", Strategy: StrategyDesktop})
+	if err != nil {
+		t.Fatalf("run() should not fail if the CrUX History lookup fails: %v", err)
+	}
+	if result.Lighthouse == nil || result.LoadingExperienceHistory != nil || result.OriginLoadingExperienceHistory != nil {
+		t.Errorf("run() = %+v, want the result of the next backend without history", result)
+	}
+	if runs != 4 {
+		t.Errorf("the next backend ran %d times, want a run for every request", runs)
+	}
+}
+
+func Test_collectHistory(t *testing.T) {
+	coll := collector{
+		scrapeService: fakeScrapeService{results: []*ScrapeResult{{
+			Request: ScrapeRequest{Url: "https://www.example.com/", Strategy: StrategyMobile},
+			Result: &Result{
+				LoadingExperienceHistory: &LoadingExperienceHistory{
+					PeriodEnds: []time.Time{time.Date(2024, 10, 28, 0, 0, 0, 0, time.UTC), time.Date(2024, 11, 4, 0, 0, 0, 0, time.UTC)},
+					Metrics: map[string][]*CrUXMetric{
+						"LARGEST_CONTENTFUL_PAINT_MS": {
+							nil,
+							{Percentile: 2612, Distributions: []Bucket{{Max: 2500, Proportion: 0.75}, {Min: 2500, Max: 4000, Proportion: 0.16}, {Min: 4000, Proportion: 0.09}}},
+						},
+						"SOME_FUTURE_METRIC": {{Percentile: 42}, {Percentile: 42}},
+					},
+				},
+			},
+		}}},
+		descs: newDescriptors(),
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(coll); err != nil {
+		t.Fatalf("could not register collector: %v", err)
+	}
+
+	expected := `
+# HELP pagespeed_loading_experience_history_metrics_largest_contentful_paint_category_ratio Weekly proportion of page loads in the specified category
+# TYPE pagespeed_loading_experience_history_metrics_largest_contentful_paint_category_ratio gauge
+pagespeed_loading_experience_history_metrics_largest_contentful_paint_category_ratio{category="average",host="https://www.example.com",path="/",strategy="mobile",weeks_ago="0"} 0.16
+pagespeed_loading_experience_history_metrics_largest_contentful_paint_category_ratio{category="fast",host="https://www.example.com",path="/",strategy="mobile",weeks_ago="0"} 0.75
+pagespeed_loading_experience_history_metrics_largest_contentful_paint_category_ratio{category="slow",host="https://www.example.com",path="/",strategy="mobile",weeks_ago="0"} 0.09
+# HELP pagespeed_loading_experience_history_metrics_largest_contentful_paint_duration_seconds Weekly percentile metrics for largest contentful paint
+# TYPE pagespeed_loading_experience_history_metrics_largest_contentful_paint_duration_seconds gauge
+pagespeed_loading_experience_history_metrics_largest_contentful_paint_duration_seconds{host="https://www.example.com",path="/",strategy="mobile",weeks_ago="0"} 2.612
+# HELP pagespeed_loading_experience_history_period_end_timestamp_seconds Last day of the collection period of the weekly loading experience metrics
+# TYPE pagespeed_loading_experience_history_period_end_timestamp_seconds gauge
+pagespeed_loading_experience_history_period_end_timestamp_seconds{host="https://www.example.com",path="/",strategy="mobile",weeks_ago="0"} 1.7306784e+09
+pagespeed_loading_experience_history_period_end_timestamp_seconds{host="https://www.example.com",path="/",strategy="mobile",weeks_ago="1"} 1.7300736e+09
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"pagespeed_loading_experience_history_metrics_largest_contentful_paint_category_ratio",
+		"pagespeed_loading_experience_history_metrics_largest_contentful_paint_duration_seconds",
+		"pagespeed_loading_experience_history_period_end_timestamp_seconds",
+	); err != nil {
+		t.Error(err)
+	}
+}
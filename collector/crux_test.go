@@ -0,0 +1,257 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/option"
+)
+
+// newCrUXServer serves the method of the CrUX API from the fixtures keyed by the queried url or origin and form factor
+func newCrUXServer(t *testing.T, method string, fixtures map[cruxQuery]string) (server *httptest.Server, calls *int32) {
+	t.Helper()
+	calls = new(int32)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/records:"+method || r.URL.Query().Get("key") != "KEY" {
+			http.Error(w, `{"error":{"code":400,"message":"unexpected request","status":"INVALID_ARGUMENT"}}`, http.StatusBadRequest)
+			return
+		}
+
+		var query cruxQuery
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			http.Error(w, `{"error":{"code":400,"message":"invalid body","status":"INVALID_ARGUMENT"}}`, http.StatusBadRequest)
+			return
+		}
+
+		fixture, ok := fixtures[query]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":{"code":404,"message":"chrome ux report data not found","status":"NOT_FOUND"}}`))
+			return
+		}
+
+		data, err := os.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func newTestCrUXClient(t *testing.T, endpoint string) *cruxClient {
+	t.Helper()
+	client, err := newGoogleClient(0, nil, []option.ClientOption{option.WithAPIKey("KEY")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cruxClient{endpoint: endpoint, client: client}
+}
+
+var testCrUXFixtures = map[cruxQuery]string{
+	{URL: "https://www.example.com/", FormFactor: "PHONE"}:   "crux-url.json",
+	{Origin: "https://www.example.com", FormFactor: "PHONE"}: "crux-origin.json",
+}
+
+func Test_cruxClient_queryRecord(t *testing.T) {
+	server, _ := newCrUXServer(t, "queryRecord", testCrUXFixtures)
+	client := newTestCrUXClient(t, server.URL)
+
+	l, err := client.queryRecord(context.Background(), cruxQuery{URL: "https://www.example.com/", FormFactor: "PHONE"})
+	if err != nil {
+		t.Fatalf("queryRecord should not throw an error: %v", err)
+	}
+
+	if l.OverallCategory != "AVERAGE" {
+		t.Errorf("overall category = %q, want AVERAGE for the p75 LCP above 2.5s", l.OverallCategory)
+	}
+
+	wantCLS := CrUXMetric{Percentile: 5, Distributions: []Bucket{{Min: 0, Max: 10, Proportion: 0.8712}, {Min: 10, Max: 25, Proportion: 0.0813}, {Min: 25, Proportion: 0.0475}}}
+	if cls := l.Metrics["CUMULATIVE_LAYOUT_SHIFT_SCORE"]; !reflect.DeepEqual(cls, wantCLS) {
+		t.Errorf("layout shift = %+v, want it scaled like the PageSpeed Insights API %+v", cls, wantCLS)
+	}
+	if lcp := l.Metrics["LARGEST_CONTENTFUL_PAINT_MS"]; lcp.Percentile != 2612 || len(lcp.Distributions) != 3 || lcp.Distributions[0].Max != 2500 {
+		t.Errorf("largest contentful paint = %+v, want p75 2612 with 3 buckets", lcp)
+	}
+	if rtt, ok := l.Metrics["ROUND_TRIP_TIME"]; !ok || rtt.Percentile != 187 || rtt.Distributions != nil {
+		t.Errorf("round trip time = %+v, want unknown metrics by their upper case name", rtt)
+	}
+	if _, ok := l.Metrics["NAVIGATION_TYPES"]; ok {
+		t.Error("metrics without percentiles should be skipped")
+	}
+
+	missing, err := client.queryRecord(context.Background(), cruxQuery{URL: "https://www.example.com/", FormFactor: "DESKTOP"})
+	if err != nil || missing != nil {
+		t.Errorf("queryRecord() = %v, %v, want no record and no error without CrUX data", missing, err)
+	}
+}
+
+func Test_overallCategory(t *testing.T) {
+	buckets := []Bucket{{Max: 2500}, {Min: 2500, Max: 4000}, {Min: 4000}}
+	shift := []Bucket{{Max: 10}, {Min: 10, Max: 25}, {Min: 25}}
+
+	tests := []struct {
+		name    string
+		metrics map[string]CrUXMetric
+		want    string
+	}{
+		{"no core web vitals", map[string]CrUXMetric{"FIRST_CONTENTFUL_PAINT_MS": {Percentile: 900, Distributions: buckets}}, "NONE"},
+		{"fast", map[string]CrUXMetric{"LARGEST_CONTENTFUL_PAINT_MS": {Percentile: 2000, Distributions: buckets}, "CUMULATIVE_LAYOUT_SHIFT_SCORE": {Percentile: 5, Distributions: shift}}, "FAST"},
+		{"slowest decides", map[string]CrUXMetric{"LARGEST_CONTENTFUL_PAINT_MS": {Percentile: 2000, Distributions: buckets}, "CUMULATIVE_LAYOUT_SHIFT_SCORE": {Percentile: 12, Distributions: shift}}, "AVERAGE"},
+		{"slow", map[string]CrUXMetric{"LARGEST_CONTENTFUL_PAINT_MS": {Percentile: 4100, Distributions: buckets}, "CUMULATIVE_LAYOUT_SHIFT_SCORE": {Percentile: 12, Distributions: shift}}, "SLOW"},
+		{"boundary is good", map[string]CrUXMetric{"LARGEST_CONTENTFUL_PAINT_MS": {Percentile: 2500, Distributions: buckets}}, "FAST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overallCategory(tt.metrics); got != tt.want {
+				t.Errorf("overallCategory() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cruxBackend(t *testing.T) {
+	server, calls := newCrUXServer(t, "queryRecord", testCrUXFixtures)
+	b := &cruxBackend{client: newTestCrUXClient(t, server.URL), records: newCrUXRecords[*LoadingExperience](time.Hour)}
+
+	mobile := ScrapeRequest{Url: "https://www.example.com/", Strategy: StrategyMobile}
+	for i := 0; i < 2; i++ {
+		result, err := b.run(context.Background(), mobile)
+		if err != nil {
+			t.Fatalf("run() should not throw an error: %v", err)
+		}
+		if result.LoadingExperience == nil || result.OriginLoadingExperience == nil || result.Lighthouse != nil {
+			t.Fatalf("run() = %+v, want field data of the page and origin only", result)
+		}
+		if p := result.OriginLoadingExperience.Metrics["LARGEST_CONTENTFUL_PAINT_MS"].Percentile; p != 1904 {
+			t.Errorf("origin largest contentful paint = %v, want 1904", p)
+		}
+	}
+	if *calls != 2 {
+		t.Errorf("CrUX API was called %d times, want the records to be reused", *calls)
+	}
+
+	result, err := b.run(context.Background(), ScrapeRequest{Url: "https://www.example.com/", Strategy: StrategyDesktop})
+	if err != nil {
+		t.Fatalf("run() should not throw an error: %v", err)
+	}
+	if result.LoadingExperience != nil || result.OriginLoadingExperience != nil {
+		t.Errorf("run() = %+v, want no field data without CrUX records", result)
+	}
+}
+
+// backendFunc runs the function as a backend
+type backendFunc func(ctx context.Context, request ScrapeRequest) (*Result, error)
+
+func (f backendFunc) run(ctx context.Context, request ScrapeRequest) (*Result, error) {
+	return f(ctx, request)
+}
+
+func Test_fieldDataBackend(t *testing.T) {
+	server, _ := newCrUXServer(t, "queryRecord", testCrUXFixtures)
+	var labRuns int32
+	b := &fieldDataBackend{
+		lab: backendFunc(func(ctx context.Context, request ScrapeRequest) (*Result, error) {
+			atomic.AddInt32(&labRuns, 1)
+			return &Result{Lighthouse: &LighthouseResult{TotalDuration: 12500}}, nil
+		}),
+		field: &cruxBackend{client: newTestCrUXClient(t, server.URL)},
+	}
+
+	result, err := b.run(context.Background(), ScrapeRequest{Url: "https://www.example.com/", Strategy: StrategyMobile})
+	if err != nil {
+		t.Fatalf("run() should not throw an error: %v", err)
+	}
+	if result.Lighthouse == nil || result.LoadingExperience == nil || result.OriginLoadingExperience == nil {
+		t.Errorf("run() = %+v, want lab and field data", result)
+	}
+
+	b.field.client.endpoint = server.URL + "/unknown"
+	result, err = b.run(context.Background(), ScrapeRequest{Url: "https://www.example.com/", Strategy: StrategyMobile})
+	if err != nil {
+		t.Fatalf("run() should not fail if the CrUX lookup fails: %v", err)
+	}
+	if result.Lighthouse == nil || result.LoadingExperience != nil || result.OriginLoadingExperience != nil {
+		t.Errorf("run() = %+v, want the lab data only after a failed CrUX lookup", result)
+	}
+	if labRuns != 2 {
+		t.Errorf("lab backend ran %d times, want a run for every request", labRuns)
+	}
+}
+
+func Test_fieldDataCollectorWithoutCrUXData(t *testing.T) {
+	server, _ := newCrUXServer(t, "queryRecord", testCrUXFixtures)
+	path, _ := fakeLighthouse(t, "lighthouse.json", 0, "")
+
+	// CrUX has no data for the page, but for its origin
+	coll, err := NewFactory(WithLighthouseCLI(path, ""), WithCrUXAPI(server.URL, 0)).Create(Config{
+		GoogleAPIKey:   "KEY",
+		ScrapeRequests: []ScrapeRequest{{Url: "https://www.example.com/new", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}}},
+	})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+
+	expected := `
+# HELP pagespeed_lighthouse_category_score Lighthouse score for the specified category
+# TYPE pagespeed_lighthouse_category_score gauge
+pagespeed_lighthouse_category_score{category="performance",host="https://www.example.com",path="/new",strategy="mobile"} 0.91
+# HELP pagespeed_origin_loading_experience_metrics_cumulative_layout_shift_score Percentile metrics for cumulative layout shift score
+# TYPE pagespeed_origin_loading_experience_metrics_cumulative_layout_shift_score gauge
+pagespeed_origin_loading_experience_metrics_cumulative_layout_shift_score{host="https://www.example.com",path="/new",strategy="mobile"} 0.02
+# HELP pagespeed_up Whether the last scrape of the target was successful (1) or not (0)
+# TYPE pagespeed_up gauge
+pagespeed_up{host="https://www.example.com",path="/new",strategy="mobile"} 1
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected),
+		"pagespeed_lighthouse_category_score",
+		"pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds",
+		"pagespeed_origin_loading_experience_metrics_cumulative_layout_shift_score",
+		"pagespeed_scrape_target_error",
+		"pagespeed_up",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_cruxCollector(t *testing.T) {
+	server, _ := newCrUXServer(t, "queryRecord", testCrUXFixtures)
+
+	coll, err := NewFactory(WithCrUXAPI(server.URL, time.Hour)).Create(Config{
+		GoogleAPIKey:   "KEY",
+		ScrapeRequests: []ScrapeRequest{{Url: "https://www.example.com/", Strategy: StrategyMobile}},
+	})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+
+	expected := `
+# HELP pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds Percentile metrics for largest contentful paint
+# TYPE pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds gauge
+pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds{host="https://www.example.com",path="/",strategy="mobile"} 2.612
+# HELP pagespeed_origin_loading_experience_metrics_cumulative_layout_shift_score Percentile metrics for cumulative layout shift score
+# TYPE pagespeed_origin_loading_experience_metrics_cumulative_layout_shift_score gauge
+pagespeed_origin_loading_experience_metrics_cumulative_layout_shift_score{host="https://www.example.com",path="/",strategy="mobile"} 0.02
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected),
+		"pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds",
+		"pagespeed_origin_loading_experience_metrics_cumulative_layout_shift_score",
+	); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,221 @@
+package collector
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	prefixLoadingExperience              = "loading_experience"
+	prefixOriginLoadingExperience        = "origin_loading_experience"
+	prefixLoadingExperienceHistory       = "loading_experience_history"
+	prefixOriginLoadingExperienceHistory = "origin_loading_experience_history"
+	prefixLighthouse                     = "lighthouse"
+)
+
+// targetLabels are the variable labels identifying a scrape target on every target metric
+var targetLabels = []string{"host", "path", "strategy"}
+
+// descriptors holds every metric descriptor a collector can emit. It is built once
+// per collector so Describe announces the complete set and Collect reuses it.
+type descriptors struct {
+	scrapeError    *prometheus.Desc
+	scrapeDuration *prometheus.Desc
+
+	targetUp             *prometheus.Desc
+	targetScrapeDuration *prometheus.Desc
+	targetScrapeError    *prometheus.Desc
+	targetAge            *prometheus.Desc
+	targetStale          *prometheus.Desc
+
+	lighthouseTotalDuration *prometheus.Desc
+	lighthouseCategoryScore *prometheus.Desc
+	lighthouseAuditScore    *prometheus.Desc
+	lighthouseAuditNumeric  map[string]*prometheus.Desc // keyed by Lighthouse numericUnit
+
+	lighthouseRuns               *prometheus.Desc
+	lighthouseCategoryScoreStats runStatsDescs
+	lighthouseAuditScoreStats    runStatsDescs
+	lighthouseAuditNumericStats  map[string]runStatsDescs // keyed by Lighthouse numericUnit
+
+	loadingExperiences map[string]*loadingExperienceDescs // keyed by prefix
+	histories          map[string]*historyDescs           // keyed by prefix
+}
+
+// loadingExperienceDescs are the descriptors of a CrUX loading experience
+type loadingExperienceDescs struct {
+	score    *prometheus.Desc
+	metrics  map[string]cruxDescs // keyed by CrUX metric key
+	fallback cruxDescs            // for unknown CrUX metric keys, labeled with the key
+}
+
+// historyDescs are the descriptors of the weekly CrUX metrics of a loading experience,
+// labeled with the number of weeks before the latest collection period
+type historyDescs struct {
+	periodEnd *prometheus.Desc
+	metrics   map[string]cruxDescs // keyed by CrUX metric key, without thresholds
+}
+
+// runStatsDescs are the descriptors of the spread of a lighthouse value over several runs
+type runStatsDescs struct {
+	min    *prometheus.Desc
+	max    *prometheus.Desc
+	stddev *prometheus.Desc
+}
+
+// cruxDescs are the descriptors of a single CrUX metric
+type cruxDescs struct {
+	unit      unit
+	value     *prometheus.Desc
+	ratio     *prometheus.Desc
+	threshold *prometheus.Desc // nil does not export the thresholds
+}
+
+func newDescriptors() *descriptors {
+	d := &descriptors{
+		scrapeError:    prometheus.NewDesc(fqname("error"), "Error scraping target", nil, nil),
+		scrapeDuration: prometheus.NewDesc(fqname("scrape_duration_seconds"), "Total Pagespeed time scrape took for all targets.", nil, nil),
+
+		targetUp:             newTargetDesc(fqname("up"), "Whether the last scrape of the target was successful (1) or not (0)"),
+		targetScrapeDuration: newTargetDesc(fqname("scrape_target_duration_seconds"), "Time the last scrape of the target took"),
+		targetScrapeError:    newTargetDesc(fqname("scrape_target_error"), "Set to 1 with the error class if the last scrape of the target failed", "class"),
+		targetAge:            newTargetDesc(fqname("scrape_target_age_seconds"), "Age of the exported result of the target when refreshed in the background"),
+		targetStale:          newTargetDesc(fqname("scrape_target_stale_seconds"), "Time since the exported result of the target expired in the cache, 0 if it is fresh"),
+
+		lighthouseTotalDuration: newTargetDesc(fqname(prefixLighthouse, "total_duration_seconds"), "The total time spent in seconds loading the page and evaluating audits."),
+		lighthouseCategoryScore: newTargetDesc(fqname(prefixLighthouse, "category_score"), "Lighthouse score for the specified category", "category"),
+		lighthouseAuditScore:    newTargetDesc(fqname(prefixLighthouse, "audit_score"), "Lighthouse audit scores", "audit"),
+		lighthouseAuditNumeric:  make(map[string]*prometheus.Desc, len(lighthouseUnits)),
+
+		lighthouseRuns:               newTargetDesc(fqname(prefixLighthouse, "runs"), "Number of lighthouse runs aggregated into the median of the lighthouse metrics"),
+		lighthouseCategoryScoreStats: newRunStatsDescs(fqname(prefixLighthouse, "category_score"), "Lighthouse score for the specified category", "category"),
+		lighthouseAuditScoreStats:    newRunStatsDescs(fqname(prefixLighthouse, "audit_score"), "Lighthouse audit scores", "audit"),
+		lighthouseAuditNumericStats:  make(map[string]runStatsDescs, len(lighthouseUnits)),
+
+		loadingExperiences: map[string]*loadingExperienceDescs{
+			prefixLoadingExperience:       newLoadingExperienceDescs(prefixLoadingExperience),
+			prefixOriginLoadingExperience: newLoadingExperienceDescs(prefixOriginLoadingExperience),
+		},
+		histories: map[string]*historyDescs{
+			prefixLoadingExperienceHistory:       newHistoryDescs(prefixLoadingExperienceHistory),
+			prefixOriginLoadingExperienceHistory: newHistoryDescs(prefixOriginLoadingExperienceHistory),
+		},
+	}
+
+	for numericUnit, u := range lighthouseUnits {
+		d.lighthouseAuditNumeric[numericUnit] = newTargetDesc(fqname(prefixLighthouse, "audit", u.suffix), "Lighthouse audit numeric values", "audit")
+		d.lighthouseAuditNumericStats[numericUnit] = newRunStatsDescs(fqname(prefixLighthouse, "audit", u.suffix), "Lighthouse audit numeric values", "audit")
+	}
+
+	return d
+}
+
+func newLoadingExperienceDescs(prefix string) *loadingExperienceDescs {
+	d := &loadingExperienceDescs{
+		score:   newTargetDesc(fqname(prefix, "score"), "The specified score for the loading experience (1 FAST / 0.5 AVERAGE / 0 SLOW)  "),
+		metrics: make(map[string]cruxDescs, len(cruxMetrics)),
+		fallback: cruxDescs{
+			unit:      unitRaw,
+			value:     newTargetDesc(fqname(prefix, "metrics", "value"), "Percentile metrics for loading experience metrics without a known unit", "metric"),
+			ratio:     newTargetDesc(fqname(prefix, "metrics", "category_ratio"), "Proportion of page loads in the specified category", "metric", "category"),
+			threshold: newTargetDesc(fqname(prefix, "metrics", "threshold"), "Threshold between the specified categories", "metric", "threshold"),
+		},
+	}
+
+	for k, m := range cruxMetrics {
+		value, ratio, threshold := m.names(prefix)
+		d.metrics[k] = cruxDescs{
+			unit:      m.unit,
+			value:     newTargetDesc(value, "Percentile metrics for "+strings.Replace(m.name, "_", " ", -1)),
+			ratio:     newTargetDesc(ratio, "Proportion of page loads in the specified category", "category"),
+			threshold: newTargetDesc(threshold, "Threshold between the specified categories", "threshold"),
+		}
+	}
+
+	return d
+}
+
+func newHistoryDescs(prefix string) *historyDescs {
+	d := &historyDescs{
+		periodEnd: newTargetDesc(fqname(prefix, "period_end_timestamp_seconds"), "Last day of the collection period of the weekly loading experience metrics", "weeks_ago"),
+		metrics:   make(map[string]cruxDescs, len(cruxMetrics)),
+	}
+
+	for k, m := range cruxMetrics {
+		value, ratio, _ := m.names(prefix)
+		d.metrics[k] = cruxDescs{
+			unit:  m.unit,
+			value: newTargetDesc(value, "Weekly percentile metrics for "+strings.Replace(m.name, "_", " ", -1), "weeks_ago"),
+			ratio: newTargetDesc(ratio, "Weekly proportion of page loads in the specified category", "weeks_ago", "category"),
+		}
+	}
+
+	return d
+}
+
+// newTargetDesc creates a descriptor labeled with the target labels followed by the given labels
+func newTargetDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(name, help, append(append([]string{}, targetLabels...), labels...), nil)
+}
+
+// newRunStatsDescs creates the descriptors of the spread of the metric with the given name over several runs
+func newRunStatsDescs(name, help string, labels ...string) runStatsDescs {
+	return runStatsDescs{
+		min:    newTargetDesc(name+"_min", help+", minimum of all runs", labels...),
+		max:    newTargetDesc(name+"_max", help+", maximum of all runs", labels...),
+		stddev: newTargetDesc(name+"_stddev", help+", standard deviation of all runs", labels...),
+	}
+}
+
+// describe sends all descriptors to the channel
+func (d *descriptors) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.scrapeError
+	ch <- d.scrapeDuration
+	ch <- d.targetUp
+	ch <- d.targetScrapeDuration
+	ch <- d.targetScrapeError
+	ch <- d.targetAge
+	ch <- d.targetStale
+	ch <- d.lighthouseTotalDuration
+	ch <- d.lighthouseCategoryScore
+	ch <- d.lighthouseAuditScore
+	for _, desc := range d.lighthouseAuditNumeric {
+		ch <- desc
+	}
+	ch <- d.lighthouseRuns
+	d.lighthouseCategoryScoreStats.describe(ch)
+	d.lighthouseAuditScoreStats.describe(ch)
+	for _, descs := range d.lighthouseAuditNumericStats {
+		descs.describe(ch)
+	}
+
+	for _, lexp := range d.loadingExperiences {
+		ch <- lexp.score
+		for _, m := range lexp.metrics {
+			m.describe(ch)
+		}
+		lexp.fallback.describe(ch)
+	}
+
+	for _, h := range d.histories {
+		ch <- h.periodEnd
+		for _, m := range h.metrics {
+			m.describe(ch)
+		}
+	}
+}
+
+func (d cruxDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.value
+	ch <- d.ratio
+	if d.threshold != nil {
+		ch <- d.threshold
+	}
+}
+
+func (d runStatsDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.min
+	ch <- d.max
+	ch <- d.stddev
+}
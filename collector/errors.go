@@ -0,0 +1,170 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	ErrorClassQuota      = ErrorClass("quota")
+	ErrorClassHTTP       = ErrorClass("http")
+	ErrorClassLighthouse = ErrorClass("lighthouse")
+	ErrorClassTimeout    = ErrorClass("timeout")
+	ErrorClassCanceled   = ErrorClass("canceled")
+	ErrorClassUnknown    = ErrorClass("unknown")
+)
+
+// ErrorClass categorizes why scraping a target failed
+type ErrorClass string
+
+// quotaReasons are the google API error reasons signaling an exhausted quota
+var quotaReasons = map[string]bool{
+	"dailyLimitExceeded":    true,
+	"quotaExceeded":         true,
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// transientLighthouseErrors are Lighthouse runtime error codes which usually succeed when retried
+var transientLighthouseErrors = map[string]bool{
+	"CRI_TIMEOUT":             true,
+	"FAILED_DOCUMENT_REQUEST": true,
+	"NO_FCP":                  true,
+	"PAGE_HUNG":               true,
+	"PROTOCOL_TIMEOUT":        true,
+	"TARGET_CRASHED":          true,
+}
+
+// lighthouseErrorRe extracts the Lighthouse runtime error code from API error messages
+var lighthouseErrorRe = regexp.MustCompile(`Lighthouse returned error: ([A-Z_]+)`)
+
+// LighthouseError is returned when Lighthouse could not audit the target
+type LighthouseError struct {
+	Code    string
+	Message string
+}
+
+func (e *LighthouseError) Error() string {
+	return fmt.Sprintf("lighthouse returned error %s: %s", e.Code, e.Message)
+}
+
+// classifyError returns the class of an error returned by scraping a target
+func classifyError(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+
+	if lighthouseErrorCode(err) != "" {
+		return ErrorClassLighthouse
+	}
+
+	if errors.Is(err, ErrNoAPIKey) {
+		return ErrorClassQuota
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusTooManyRequests:
+			return ErrorClassQuota
+		case apiErr.Code == http.StatusForbidden && hasQuotaReason(apiErr):
+			return ErrorClassQuota
+		default:
+			return ErrorClassHTTP
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassCanceled
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	return ErrorClassUnknown
+}
+
+// isRetryable returns true for errors which are likely to succeed on a later attempt,
+// like rate limits, server errors, timeouts and flaky Lighthouse runs. Invalid requests,
+// exhausted daily quotas and pages Lighthouse can not audit are permanent.
+func isRetryable(err error) bool {
+	if code := lighthouseErrorCode(err); code != "" {
+		return transientLighthouseErrors[code]
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusTooManyRequests:
+			return !dailyQuotaExceeded(apiErr)
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		case http.StatusForbidden:
+			return hasReason(apiErr, "rateLimitExceeded", "userRateLimitExceeded") && !dailyQuotaExceeded(apiErr)
+		default:
+			return false
+		}
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// dailyQuotaExceeded returns true if the error signals an exhausted daily quota, which is only reset at
+// midnight pacific time. The API answers with a rateLimitExceeded reason for these, naming the daily limit.
+func dailyQuotaExceeded(err *googleapi.Error) bool {
+	return hasReason(err, "dailyLimitExceeded") || strings.Contains(strings.ToLower(err.Message), "per day")
+}
+
+// lighthouseErrorCode returns the Lighthouse runtime error code of the error, if any
+func lighthouseErrorCode(err error) string {
+	var lighthouseErr *LighthouseError
+	if errors.As(err, &lighthouseErr) {
+		return lighthouseErr.Code
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if m := lighthouseErrorRe.FindStringSubmatch(apiErr.Message); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+func hasQuotaReason(err *googleapi.Error) bool {
+	for _, item := range err.Errors {
+		if quotaReasons[item.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+func hasReason(err *googleapi.Error, reasons ...string) bool {
+	for _, item := range err.Errors {
+		for _, r := range reasons {
+			if item.Reason == r {
+				return true
+			}
+		}
+	}
+	return false
+}
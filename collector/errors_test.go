@@ -0,0 +1,65 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+func Test_classifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ""},
+		{"too many requests", &googleapi.Error{Code: http.StatusTooManyRequests}, ErrorClassQuota},
+		{"daily limit", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "dailyLimitExceeded"}}}, ErrorClassQuota},
+		{"forbidden", &googleapi.Error{Code: http.StatusForbidden}, ErrorClassHTTP},
+		{"bad request", &googleapi.Error{Code: http.StatusBadRequest}, ErrorClassHTTP},
+		{"lighthouse http", &googleapi.Error{Code: http.StatusInternalServerError, Message: "Lighthouse returned error: FAILED_DOCUMENT_REQUEST."}, ErrorClassLighthouse},
+		{"lighthouse runtime", &LighthouseError{Code: "NO_FCP"}, ErrorClassLighthouse},
+		{"wrapped timeout", errors.Wrap(context.DeadlineExceeded, "scrape"), ErrorClassTimeout},
+		{"canceled", context.Canceled, ErrorClassCanceled},
+		{"unknown", errors.New("pancake"), ErrorClassUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"too many requests", &googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{"service unavailable", &googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+		{"rate limit", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{"daily limit", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "dailyLimitExceeded"}}}, false},
+		{"daily quota", &googleapi.Error{Code: http.StatusTooManyRequests, Message: "Quota exceeded for quota metric 'Queries' and limit 'Queries per day' of service 'pagespeedonline.googleapis.com'", Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, false},
+		{"minute quota", &googleapi.Error{Code: http.StatusTooManyRequests, Message: "Quota exceeded for quota metric 'Queries' and limit 'Queries per minute' of service 'pagespeedonline.googleapis.com'", Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{"invalid url", &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid value at 'url'"}, false},
+		{"failed document request", &googleapi.Error{Code: http.StatusInternalServerError, Message: "Lighthouse returned error: FAILED_DOCUMENT_REQUEST. Lighthouse was unable to reliably load the page."}, true},
+		{"dns failure", &googleapi.Error{Code: http.StatusInternalServerError, Message: "Lighthouse returned error: DNS_FAILURE."}, false},
+		{"runtime no fcp", &LighthouseError{Code: "NO_FCP"}, true},
+		{"runtime not html", &LighthouseError{Code: "NOT_HTML"}, false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"unknown", errors.New("pancake"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
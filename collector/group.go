@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ prometheus.Collector = &RequestGroup{}
+
+// RequestGroup coalesces identical scrape requests in flight at the same time,
+// so concurrent callers like HA Prometheus pairs share a single API call and result.
+type RequestGroup struct {
+	flights map[string]*flight
+	mutex   sync.Mutex
+
+	coalesced float64
+
+	coalescedDesc *prometheus.Desc
+}
+
+// flight is a scrape in progress. It is canceled once every waiting caller gave up.
+type flight struct {
+	done    chan struct{}
+	result  *ScrapeResult
+	err     error
+	waiting int
+	cancel  context.CancelFunc
+}
+
+// NewRequestGroup creates an empty request group
+func NewRequestGroup() *RequestGroup {
+	return &RequestGroup{
+		flights:       make(map[string]*flight),
+		coalescedDesc: prometheus.NewDesc(fqname("scrape_coalesced_requests_total"), "Total scrape requests which joined an identical request in flight instead of calling the API", nil, nil),
+	}
+}
+
+// do calls fn for the key unless a call for the same key is in flight, in which case it waits
+// for that call and returns its result. fn runs with a context which is canceled once the
+// contexts of all callers waiting for it are done. A nil group calls fn directly.
+func (g *RequestGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (*ScrapeResult, error)) (*ScrapeResult, error) {
+	if g == nil {
+		return fn(ctx)
+	}
+
+	g.mutex.Lock()
+	f, ok := g.flights[key]
+	if ok {
+		g.coalesced++
+	} else {
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+
+		go func() {
+			f.result, f.err = fn(flightCtx)
+			cancel()
+
+			g.mutex.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mutex.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiting++
+	g.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		g.mutex.Lock()
+		f.waiting--
+		if f.waiting == 0 {
+			// nobody is interested anymore, later requests start a new flight
+			f.cancel()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (g *RequestGroup) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.coalescedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (g *RequestGroup) Collect(ch chan<- prometheus.Metric) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(g.coalescedDesc, prometheus.CounterValue, g.coalesced)
+}
@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestGroup_do(t *testing.T) {
+	g := NewRequestGroup()
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*ScrapeResult, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &ScrapeResult{Request: ScrapeRequest{Url: "https://example.com/"}}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*ScrapeResult, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do(context.Background(), "key", fn)
+		}(i)
+	}
+
+	// wait until all callers joined the flight
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		g.mutex.Lock()
+		coalesced := g.coalesced
+		g.mutex.Unlock()
+		if coalesced == 4 {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn was called %d times, want 1", calls)
+	}
+	for i, r := range results {
+		if r != results[0] {
+			t.Errorf("caller %d got result %p, want the shared result %p", i, r, results[0])
+		}
+	}
+
+	expected := `
+# HELP pagespeed_scrape_coalesced_requests_total Total scrape requests which joined an identical request in flight instead of calling the API
+# TYPE pagespeed_scrape_coalesced_requests_total counter
+pagespeed_scrape_coalesced_requests_total 4
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestGroup_doCanceled(t *testing.T) {
+	g := NewRequestGroup()
+
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (*ScrapeResult, error) {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := g.do(ctx, "key", fn)
+		errs <- err
+	}()
+	<-started
+
+	// a second caller keeps the flight alive after the first one gave up
+	ctxOther, cancelOther := context.WithCancel(context.Background())
+	go func() {
+		_, err := g.do(ctxOther, "key", fn)
+		errs <- err
+	}()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		g.mutex.Lock()
+		waiting := g.flights["key"].waiting
+		g.mutex.Unlock()
+		if waiting == 2 {
+			break
+		}
+	}
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("do() error = %v, want context.Canceled", err)
+	}
+	select {
+	case <-canceled:
+		t.Fatal("flight should not be canceled while a caller is waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancelOther()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("do() error = %v, want context.Canceled", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("flight should be canceled once all callers gave up")
+	}
+}
+
+func TestRequestGroup_doNil(t *testing.T) {
+	var g *RequestGroup
+	result, err := g.do(context.Background(), "key", func(ctx context.Context) (*ScrapeResult, error) {
+		return &ScrapeResult{}, nil
+	})
+	if result == nil || err != nil {
+		t.Errorf("do() = %v, %v, want the result of fn", result, err)
+	}
+}
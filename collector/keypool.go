@@ -0,0 +1,248 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+var _ prometheus.Collector = &KeyPool{}
+
+const (
+	KeyStrategyRoundRobin = KeyStrategy("round-robin")
+	KeyStrategyBudget     = KeyStrategy("budget")
+
+	// DefaultKeyBench is how long a key is not used after it was rate limited
+	DefaultKeyBench = 5 * time.Minute
+)
+
+// KeyStrategy decides which key of a pool is used for the next request
+type KeyStrategy string
+
+// ErrNoAPIKey is returned if all keys of the pool are benched or out of their daily budget
+var ErrNoAPIKey = errors.New("all API keys are benched or out of budget")
+
+// quotaLocation is the time zone the daily quotas of google APIs are reset in
+var quotaLocation = loadQuotaLocation()
+
+func loadQuotaLocation() *time.Location {
+	if loc, err := time.LoadLocation("America/Los_Angeles"); err == nil {
+		return loc
+	}
+	return time.FixedZone("PST", -8*60*60)
+}
+
+// quotaDay returns the start of the quota day of the time
+func quotaDay(t time.Time) time.Time {
+	y, m, d := t.In(quotaLocation).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, quotaLocation)
+}
+
+// KeyPoolConfig configures a KeyPool
+type KeyPoolConfig struct {
+	APIKeys          []string
+	CredentialsFiles []string
+	Strategy         KeyStrategy   // defaults to round-robin
+	DailyBudget      int           // requests per key and day, 0 does not limit them
+	Bench            time.Duration // keys returning 429 or 403 are not used for this period, defaults to DefaultKeyBench
+}
+
+// KeyPool spreads the PageSpeed Insights API requests over several API keys or credentials files,
+// e.g. of projects with their own quota. Keys which are rate limited are benched for
+// a while, keys which exhausted their daily quota until it is reset at midnight pacific time.
+type KeyPool struct {
+	strategy KeyStrategy
+	budget   int
+	bench    time.Duration
+	now      func() time.Time
+
+	mu   sync.Mutex
+	keys []*poolKey
+	next int       // index of the next key for round-robin
+	day  time.Time // start of the quota day the keys were used in
+
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	benched  *prometheus.Desc
+	budgets  *prometheus.Desc
+}
+
+type poolKey struct {
+	index        int
+	id           string // hash of the key, safe to export
+	option       option.ClientOption
+	used         int // requests in the current quota day
+	benchedUntil time.Time
+}
+
+// NewKeyPool creates a key pool, nil if no keys or credentials files are configured
+func NewKeyPool(config KeyPoolConfig) (*KeyPool, error) {
+	if len(config.APIKeys) == 0 && len(config.CredentialsFiles) == 0 {
+		return nil, nil
+	}
+
+	strategy := config.Strategy
+	switch strategy {
+	case "":
+		strategy = KeyStrategyRoundRobin
+	case KeyStrategyRoundRobin, KeyStrategyBudget:
+	default:
+		return nil, errors.Errorf("unknown key strategy %q", strategy)
+	}
+
+	bench := config.Bench
+	if bench <= 0 {
+		bench = DefaultKeyBench
+	}
+
+	p := &KeyPool{
+		strategy: strategy,
+		budget:   config.DailyBudget,
+		bench:    bench,
+		now:      time.Now,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: fqname("api_key_requests_total"),
+			Help: "Number of pagespeed API requests made with the key, labeled with the hash of the key",
+		}, []string{"key"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: fqname("api_key_errors_total"),
+			Help: "Number of failed pagespeed API requests made with the key by error class, labeled with the hash of the key",
+		}, []string{"key", "class"}),
+		benched: prometheus.NewDesc(fqname("api_key_benched"), "Whether the key is benched (1) after it was rate limited, or not (0)", []string{"key"}, nil),
+		budgets: prometheus.NewDesc(fqname("api_key_remaining_budget"), "Remaining daily budget of requests of the key", []string{"key"}, nil),
+	}
+
+	for _, k := range config.APIKeys {
+		p.add(k, option.WithAPIKey(k))
+	}
+	for _, f := range config.CredentialsFiles {
+		p.add(f, option.WithCredentialsFile(f))
+	}
+	return p, nil
+}
+
+func (p *KeyPool) add(secret string, o option.ClientOption) {
+	sum := sha256.Sum256([]byte(secret))
+	p.keys = append(p.keys, &poolKey{index: len(p.keys), id: hex.EncodeToString(sum[:])[:12], option: o})
+}
+
+// acquire returns the key for the next request and counts the request
+func (p *KeyPool) acquire() (*poolKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if day := quotaDay(now); day.After(p.day) {
+		p.day = day
+		for _, k := range p.keys {
+			k.used = 0
+		}
+	}
+
+	var best *poolKey
+	for i := range p.keys {
+		k := p.keys[(p.next+i)%len(p.keys)]
+		if now.Before(k.benchedUntil) || (p.budget > 0 && k.used >= p.budget) {
+			continue
+		}
+		if p.strategy == KeyStrategyRoundRobin {
+			best = k
+			break
+		}
+		if best == nil || k.used < best.used {
+			best = k
+		}
+	}
+	if best == nil {
+		return nil, ErrNoAPIKey
+	}
+
+	p.next = (best.index + 1) % len(p.keys)
+	best.used++
+	p.requests.WithLabelValues(best.id).Inc()
+	return best, nil
+}
+
+// report counts a failed request and benches the key if it was rate limited or exceeded its quota.
+// Other denied requests, e.g. of a key without the API enabled, are logged without benching the key.
+func (p *KeyPool) report(k *poolKey, err error) {
+	if err == nil {
+		return
+	}
+	p.errors.WithLabelValues(k.id, string(classifyError(err))).Inc()
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return
+	}
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests:
+	case apiErr.Code == http.StatusForbidden && hasReason(apiErr, "rateLimitExceeded", "dailyLimitExceeded", "userRateLimitExceeded"):
+	case apiErr.Code == http.StatusForbidden:
+		log.WithError(err).WithField("key", k.id).Error("API key was denied, check that the PageSpeed Insights API is enabled and allowed for it")
+		return
+	default:
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	until := now.Add(p.bench)
+	if dailyQuotaExceeded(apiErr) {
+		until = quotaDay(now).AddDate(0, 0, 1)
+	}
+	if until.After(k.benchedUntil) {
+		k.benchedUntil = until
+	}
+	log.WithError(err).WithFields(log.Fields{
+		"key":   k.id,
+		"until": until,
+	}).Warn("benching API key")
+}
+
+// Describe implements prometheus.Collector.
+func (p *KeyPool) Describe(ch chan<- *prometheus.Desc) {
+	p.requests.Describe(ch)
+	p.errors.Describe(ch)
+	ch <- p.benched
+	if p.budget > 0 {
+		ch <- p.budgets
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (p *KeyPool) Collect(ch chan<- prometheus.Metric) {
+	p.requests.Collect(ch)
+	p.errors.Collect(ch)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	newDay := quotaDay(now).After(p.day)
+	for _, k := range p.keys {
+		var benched float64
+		if now.Before(k.benchedUntil) {
+			benched = 1
+		}
+		ch <- prometheus.MustNewConstMetric(p.benched, prometheus.GaugeValue, benched, k.id)
+
+		if p.budget > 0 {
+			used := k.used
+			if newDay {
+				used = 0
+			}
+			ch <- prometheus.MustNewConstMetric(p.budgets, prometheus.GaugeValue, float64(p.budget-used), k.id)
+		}
+	}
+}
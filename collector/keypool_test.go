@@ -0,0 +1,224 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
+)
+
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// newTestKeyPool creates a pool of the keys with a clock set by the returned function
+func newTestKeyPool(t *testing.T, config KeyPoolConfig) (*KeyPool, func(time.Time)) {
+	t.Helper()
+	p, err := NewKeyPool(config)
+	if err != nil {
+		t.Fatalf("NewKeyPool should not throw an error: %v", err)
+	}
+	now := time.Date(2024, 11, 4, 12, 0, 0, 0, quotaLocation)
+	p.now = func() time.Time { return now }
+	return p, func(t time.Time) { now = t }
+}
+
+// acquireKeys returns the hashes of the next keys acquired from the pool
+func acquireKeys(t *testing.T, p *KeyPool, n int) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < n; i++ {
+		k, err := p.acquire()
+		if err != nil {
+			t.Fatalf("acquire() #%d should not throw an error: %v", i, err)
+		}
+		ids = append(ids, k.id)
+	}
+	return ids
+}
+
+func TestNewKeyPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  KeyPoolConfig
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "no keys", config: KeyPoolConfig{Strategy: KeyStrategyBudget}, wantNil: true},
+		{name: "api keys", config: KeyPoolConfig{APIKeys: []string{"A", "B"}}},
+		{name: "credentials files", config: KeyPoolConfig{CredentialsFiles: []string{"a.json"}, Strategy: KeyStrategyBudget}},
+		{name: "unknown strategy", config: KeyPoolConfig{APIKeys: []string{"A"}, Strategy: "random"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewKeyPool(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewKeyPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got == nil) != tt.wantNil {
+				t.Errorf("NewKeyPool() = %v, want nil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestKeyPool_acquire(t *testing.T) {
+	a, b, c := keyID("A"), keyID("B"), keyID("C")
+
+	t.Run("round-robin", func(t *testing.T) {
+		p, _ := newTestKeyPool(t, KeyPoolConfig{APIKeys: []string{"A", "B", "C"}})
+		if got, want := strings.Join(acquireKeys(t, p, 4), ","), strings.Join([]string{a, b, c, a}, ","); got != want {
+			t.Errorf("acquired keys = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		p, setNow := newTestKeyPool(t, KeyPoolConfig{APIKeys: []string{"A", "B"}, Strategy: KeyStrategyBudget, DailyBudget: 2})
+		p.keys[0].used = 1
+		p.day = quotaDay(p.now())
+
+		if got, want := strings.Join(acquireKeys(t, p, 3), ","), strings.Join([]string{b, a, b}, ","); got != want {
+			t.Errorf("acquired keys = %s, want the key with the most remaining budget first: %s", got, want)
+		}
+		if _, err := p.acquire(); err != ErrNoAPIKey {
+			t.Errorf("acquire() with exhausted budgets = %v, want ErrNoAPIKey", err)
+		}
+
+		setNow(time.Date(2024, 11, 5, 0, 0, 1, 0, quotaLocation))
+		if ids := acquireKeys(t, p, 1); ids[0] != a {
+			t.Errorf("acquire() on the next quota day = %s, want the budgets to be reset", ids[0])
+		}
+	})
+}
+
+func TestKeyPool_report(t *testing.T) {
+	p, setNow := newTestKeyPool(t, KeyPoolConfig{APIKeys: []string{"A", "B"}, Bench: time.Minute})
+	start := p.now()
+	a, b := keyID("A"), keyID("B")
+
+	k, _ := p.acquire()
+	p.report(k, &googleapi.Error{Code: http.StatusTooManyRequests})
+	if ids := acquireKeys(t, p, 2); ids[0] != b || ids[1] != b {
+		t.Errorf("acquired keys = %v, want only %s while %s is benched", ids, b, a)
+	}
+
+	setNow(start.Add(time.Minute))
+	if ids := acquireKeys(t, p, 2); ids[0] != a && ids[1] != a {
+		t.Errorf("acquired keys = %v, want %s to be used again after the bench", ids, a)
+	}
+
+	for _, k := range p.keys {
+		p.report(k, &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "dailyLimitExceeded"}}})
+	}
+	setNow(start.Add(time.Hour))
+	if _, err := p.acquire(); err != ErrNoAPIKey {
+		t.Fatalf("acquire() with exhausted daily quotas = %v, want ErrNoAPIKey", err)
+	}
+	if got := classifyError(ErrNoAPIKey); got != ErrorClassQuota {
+		t.Errorf("classifyError(ErrNoAPIKey) = %s, want %s", got, ErrorClassQuota)
+	}
+
+	setNow(time.Date(2024, 11, 5, 0, 0, 0, 0, quotaLocation))
+	acquireKeys(t, p, 1)
+
+	for _, err := range []*googleapi.Error{
+		{Code: http.StatusBadRequest},
+		{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "accessNotConfigured"}}},
+		{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}, Message: "Requests from referer <empty> are blocked."},
+	} {
+		p.report(p.keys[0], err)
+		setNow(p.now().Add(time.Second))
+		if ids := acquireKeys(t, p, 2); ids[0] == ids[1] {
+			t.Errorf("acquired keys = %v, %v should not bench the key", ids, err)
+		}
+	}
+
+	p.report(p.keys[0], &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}})
+	setNow(p.now().Add(time.Second))
+	if ids := acquireKeys(t, p, 2); ids[0] != b || ids[1] != b {
+		t.Errorf("acquired keys = %v, want only %s while %s is benched for its rate limit", ids, b, a)
+	}
+}
+
+func TestKeyPoolCollector(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		mu.Lock()
+		keys = append(keys, key)
+		mu.Unlock()
+		if key == "LIMITED" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":{"code":429,"message":"Quota exceeded","errors":[{"reason":"rateLimitExceeded"}]}}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(newRunResponse(0.9, 1000))
+	}))
+	defer server.Close()
+
+	pool, err := NewKeyPool(KeyPoolConfig{APIKeys: []string{"LIMITED", "FREE"}})
+	if err != nil {
+		t.Fatalf("NewKeyPool should not throw an error: %v", err)
+	}
+
+	coll, err := NewFactory(
+		WithEndpoint(server.URL),
+		WithKeyPool(pool),
+		WithRetryPolicy(NewRetryPolicy(1, time.Millisecond, time.Millisecond)),
+	).Create(Config{
+		GoogleAPIKey: "CRUX-ONLY",
+		ScrapeRequests: []ScrapeRequest{
+			{Url: "https://example.com/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}},
+			{Url: "https://example.com/", Strategy: StrategyDesktop, Categories: []string{CategoryPerformance}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+
+	expected := `
+# HELP pagespeed_up Whether the last scrape of the target was successful (1) or not (0)
+# TYPE pagespeed_up gauge
+pagespeed_up{host="https://example.com",path="/",strategy="desktop"} 1
+pagespeed_up{host="https://example.com",path="/",strategy="mobile"} 1
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected), "pagespeed_up"); err != nil {
+		t.Error(err)
+	}
+
+	mu.Lock()
+	if got := strings.Join(keys, ","); got != "LIMITED,FREE,FREE" {
+		t.Errorf("requests were made with the keys %s, want the limited key to be benched after its first request", got)
+	}
+	mu.Unlock()
+
+	limited, free := keyID("LIMITED"), keyID("FREE")
+	expected = `
+# HELP pagespeed_api_key_benched Whether the key is benched (1) after it was rate limited, or not (0)
+# TYPE pagespeed_api_key_benched gauge
+pagespeed_api_key_benched{key="` + free + `"} 0
+pagespeed_api_key_benched{key="` + limited + `"} 1
+# HELP pagespeed_api_key_errors_total Number of failed pagespeed API requests made with the key by error class, labeled with the hash of the key
+# TYPE pagespeed_api_key_errors_total counter
+pagespeed_api_key_errors_total{class="quota",key="` + limited + `"} 1
+# HELP pagespeed_api_key_requests_total Number of pagespeed API requests made with the key, labeled with the hash of the key
+# TYPE pagespeed_api_key_requests_total counter
+pagespeed_api_key_requests_total{key="` + free + `"} 2
+pagespeed_api_key_requests_total{key="` + limited + `"} 1
+`
+	if err := testutil.CollectAndCompare(pool, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,112 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/pagespeedonline/v5"
+)
+
+// lighthouseWaitDelay is how long lighthouse may take to close chrome after it was interrupted
+const lighthouseWaitDelay = 10 * time.Second
+
+// lighthouseBackend runs lighthouse with a locally installed binary, so targets which
+// can't be reached by the PageSpeed Insights API can be audited without using its quota.
+// CrUX data is not available and campaign and source are ignored.
+type lighthouseBackend struct {
+	path        string
+	chromeFlags string
+	timeout     time.Duration // 0 does not limit a run
+}
+
+func (b *lighthouseBackend) run(ctx context.Context, request ScrapeRequest) (*Result, error) {
+	if b.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, b.path, b.args(request)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// let lighthouse close the browser it launched
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = lighthouseWaitDelay
+
+	errRun := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, errors.Wrap(ctx.Err(), "lighthouse was interrupted")
+	}
+
+	// lighthouse exits with an error on runtime errors, but still reports them
+	lhr, errParse := parseLighthouseResult(stdout.Bytes())
+	if errRun != nil && errParse != nil {
+		return nil, errors.Wrapf(errRun, "could not run lighthouse: %s", lastLine(stderr.String()))
+	}
+	if errParse != nil {
+		return nil, errParse
+	}
+
+	if err := runtimeError(lhr); err != nil {
+		return nil, err
+	}
+	return &Result{Lighthouse: newLighthouseResult(lhr)}, nil
+}
+
+// args returns the command line arguments of lighthouse for the request
+func (b *lighthouseBackend) args(request ScrapeRequest) []string {
+	args := []string{
+		request.Url,
+		"--output=json",
+		"--output-path=stdout",
+		"--quiet",
+	}
+	if b.chromeFlags != "" {
+		args = append(args, "--chrome-flags="+b.chromeFlags)
+	}
+	if request.Strategy == StrategyDesktop {
+		args = append(args, "--preset=desktop")
+	}
+	if len(request.Categories) > 0 {
+		args = append(args, "--only-categories="+strings.Join(request.Categories, ","))
+	}
+	if request.Locale != "" {
+		args = append(args, "--locale="+request.Locale)
+	}
+	return args
+}
+
+// parseLighthouseResult parses the JSON report of lighthouse. Only the parts used by the
+// collector are decoded, so other changes of the report format don't break it.
+func parseLighthouseResult(data []byte) (*pagespeedonline.LighthouseResultV5, error) {
+	var report struct {
+		Audits       map[string]pagespeedonline.LighthouseAuditResultV5 `json:"audits"`
+		Categories   *pagespeedonline.Categories                        `json:"categories"`
+		Timing       *pagespeedonline.Timing                            `json:"timing"`
+		RuntimeError *pagespeedonline.RuntimeError                      `json:"runtimeError"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, errors.Wrap(err, "could not parse lighthouse report")
+	}
+	return &pagespeedonline.LighthouseResultV5{
+		Audits:       report.Audits,
+		Categories:   report.Categories,
+		Timing:       report.Timing,
+		RuntimeError: report.RuntimeError,
+	}, nil
+}
+
+// lastLine returns the last non-empty line of the output
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
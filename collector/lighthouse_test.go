@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeLighthouse writes an executable printing the fixture like the lighthouse binary and exiting
+// with the code. Its arguments are written to the returned args file.
+func fakeLighthouse(t *testing.T, fixture string, exitCode int, stderr string) (path string, args string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping testing with a shell script on windows")
+	}
+
+	dir := t.TempDir()
+	path = filepath.Join(dir, "lighthouse")
+	args = filepath.Join(dir, "args")
+
+	var script strings.Builder
+	script.WriteString("#!/bin/sh\n")
+	script.WriteString("echo \"$@\" > '" + args + "'\n")
+	if fixture != "" {
+		fixturePath, err := filepath.Abs(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		script.WriteString("cat '" + fixturePath + "'\n")
+	}
+	if stderr != "" {
+		script.WriteString("echo '" + stderr + "' >&2\n")
+	}
+	script.WriteString("exit " + strconv.Itoa(exitCode) + "\n")
+
+	if err := os.WriteFile(path, []byte(script.String()), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path, args
+}
+
+func Test_lighthouseBackend(t *testing.T) {
+	request := ScrapeRequest{Url: "https://intranet.example/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance, CategorySEO}}
+
+	tests := []struct {
+		name     string
+		fixture  string
+		exitCode int
+		stderr   string
+		wantErr  string
+		wantCode string
+	}{
+		{name: "report", fixture: "lighthouse.json"},
+		{name: "runtime error", fixture: "lighthouse-runtime-error.json", exitCode: 1, wantErr: "ERRORED_DOCUMENT_REQUEST", wantCode: "ERRORED_DOCUMENT_REQUEST"},
+		{name: "failed", exitCode: 1, stderr: "Runtime error encountered: Chrome could not be found", wantErr: "Chrome could not be found"},
+		{name: "empty report", wantErr: "could not parse lighthouse report"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := fakeLighthouse(t, tt.fixture, tt.exitCode, tt.stderr)
+			b := &lighthouseBackend{path: path}
+
+			result, err := b.run(context.Background(), request)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("run() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				if code := lighthouseErrorCode(err); code != tt.wantCode {
+					t.Errorf("lighthouse error code = %q, want %q", code, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("run() should not throw an error: %v", err)
+			}
+
+			if result.LoadingExperience != nil || result.OriginLoadingExperience != nil {
+				t.Error("lighthouse results should not have field data")
+			}
+			lhr := result.Lighthouse
+			if lhr.TotalDuration != 12500.7 {
+				t.Errorf("total duration = %v, want 12500.7", lhr.TotalDuration)
+			}
+			if want := map[string]float64{CategoryPerformance: 0.91, CategorySEO: 0.8}; !reflect.DeepEqual(lhr.Categories, want) {
+				t.Errorf("categories = %v, want %v", lhr.Categories, want)
+			}
+			fcp := lhr.Audits["first-contentful-paint"]
+			if fcp.Score == nil || *fcp.Score != 0.98 || fcp.NumericValue != 1234.5 || fcp.NumericUnit != "millisecond" {
+				t.Errorf("first-contentful-paint = %+v, want score 0.98 and 1234.5 milliseconds", fcp)
+			}
+			if !reflect.DeepEqual(fcp.Categories, []string{CategoryPerformance}) {
+				t.Errorf("first-contentful-paint categories = %v, want performance", fcp.Categories)
+			}
+			if lhr.Audits["final-screenshot"].Score != nil {
+				t.Error("unscored audits should not have a score")
+			}
+		})
+	}
+}
+
+func Test_lighthouseBackendArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend lighthouseBackend
+		request ScrapeRequest
+		want    string
+	}{
+		{
+			name:    "mobile",
+			request: ScrapeRequest{Url: "https://intranet.example/", Strategy: StrategyMobile},
+			want:    "https://intranet.example/ --output=json --output-path=stdout --quiet",
+		},
+		{
+			name:    "desktop with categories and locale",
+			backend: lighthouseBackend{chromeFlags: "--headless --no-sandbox"},
+			request: ScrapeRequest{Url: "https://intranet.example/", Strategy: StrategyDesktop, Categories: []string{CategoryPerformance, CategorySEO}, Locale: "de", Campaign: "ignored"},
+			want:    "https://intranet.example/ --output=json --output-path=stdout --quiet --chrome-flags=--headless --no-sandbox --preset=desktop --only-categories=performance,seo --locale=de",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, args := fakeLighthouse(t, "lighthouse.json", 0, "")
+			b := tt.backend
+			b.path = path
+
+			if _, err := b.run(context.Background(), tt.request); err != nil {
+				t.Fatalf("run() should not throw an error: %v", err)
+			}
+
+			got, err := os.ReadFile(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(got)) != tt.want {
+				t.Errorf("lighthouse arguments = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_lighthouseCLICollector(t *testing.T) {
+	path, _ := fakeLighthouse(t, "lighthouse.json", 0, "")
+
+	coll, err := NewFactory(WithLighthouseCLI(path, "")).Create(Config{
+		ScrapeRequests: []ScrapeRequest{{Url: "https://intranet.example/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance, CategorySEO}}},
+	})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+
+	expected := `
+# HELP pagespeed_lighthouse_category_score Lighthouse score for the specified category
+# TYPE pagespeed_lighthouse_category_score gauge
+pagespeed_lighthouse_category_score{category="performance",host="https://intranet.example",path="/",strategy="mobile"} 0.91
+pagespeed_lighthouse_category_score{category="seo",host="https://intranet.example",path="/",strategy="mobile"} 0.8
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected), "pagespeed_lighthouse_category_score"); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,11 +1,12 @@
 package collector
 
 import (
+	"context"
 	"encoding/json"
 	"net/url"
+	"runtime"
+	"sort"
 	"time"
-
-	"google.golang.org/api/pagespeedonline/v5"
 )
 
 const (
@@ -35,8 +36,13 @@ var availableCategories = map[string]bool{
 }
 
 type ScrapeResult struct {
-	Request ScrapeRequest
-	Result  *pagespeedonline.PagespeedApiPagespeedResponseV5
+	Request   ScrapeRequest
+	Result    *Result
+	Duration  time.Duration // time it took to scrape the target
+	Timestamp time.Time     // time the result was fetched from the API
+	Error     error         `json:"-"` // set if scraping the target failed, Result is nil then
+	Stats     *RunStats     // set if the target was run several times, Result holds the medians then
+	ExpiredAt time.Time     `json:"-"` // set if the result expired in the cache and is served stale
 }
 
 type ScrapeRequest struct {
@@ -46,6 +52,44 @@ type ScrapeRequest struct {
 	Source     string   `json:"source"`
 	Locale     string   `json:"locale"`
 	Categories []string `json:"categories"`
+	Interval   Duration `json:"interval,omitempty"` // refresh the target in the background at this interval
+	Schedule   string   `json:"schedule,omitempty"` // refresh the target in the background on this cron schedule
+	Priority   int      `json:"priority,omitempty"` // targets with a higher priority are scraped first
+	Runs       int      `json:"runs,omitempty"`     // number of lighthouse runs aggregated into the result, defaults to 1
+}
+
+// Duration is a time.Duration represented as a duration string like "15m" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// runs returns the number of lighthouse runs of the target
+func (sr ScrapeRequest) runs() int {
+	if sr.Runs < 1 {
+		return 1
+	}
+	return sr.Runs
+}
+
+// IsScheduled returns true if the target defines its own refresh interval or schedule
+func (sr ScrapeRequest) IsScheduled() bool {
+	return sr.Interval > 0 || sr.Schedule != ""
 }
 
 func (sr ScrapeRequest) IsValid() bool {
@@ -67,16 +111,48 @@ func (sr ScrapeRequest) IsValid() bool {
 		return false
 	}
 
+	if sr.Runs < 0 {
+		return false
+	}
+
+	if sr.Interval < 0 || (sr.Interval > 0 && sr.Schedule != "") {
+		return false
+	}
+
+	if sr.Schedule != "" {
+		if _, err := parseCronSchedule(sr.Schedule); err != nil {
+			return false
+		}
+	}
+
 	return true
 }
 
 type Config struct {
+	Context         context.Context // bounds scraping to a request, e.g. of a probe, which scrapes all targets on collect instead of scheduling them
 	ScrapeRequests  []ScrapeRequest
 	GoogleAPIKey    string
 	CredentialsFile string
-	Parallel        bool
+	Parallel        bool // scrape with runtime.NumCPU() workers if Concurrency is not set
+	Concurrency     int  // number of targets scraped at the same time
+	HostConcurrency int  // number of targets of the same host scraped at the same time, 0 does not limit them
 	ScrapeTimeout   time.Duration
-	CacheTTL        time.Duration // cache duration, 0 disables cache
+	CacheTTL        time.Duration // cache duration, 0 disables cache, ignored if the factory shares a cache
+	CacheGrace      time.Duration // serve expired results for this period while they are refreshed in the background
+	CacheDir        string        // persists the cache in the directory, so results survive restarts
+	ScrapeInterval  time.Duration // refresh targets in the background at this interval, 0 scrapes on collect
+}
+
+// concurrency returns the number of targets to scrape at the same time
+func (c Config) concurrency() int {
+	switch {
+	case c.Concurrency > 0:
+		return c.Concurrency
+	case c.Parallel:
+		return runtime.NumCPU()
+	default:
+		return 1
+	}
 }
 
 func CalculateScrapeRequests(targets, categories []string) []ScrapeRequest {
@@ -124,15 +200,19 @@ func populateCategories(r *ScrapeRequest, cats []string) {
 		return
 	}
 
-	if cats == nil {
-		cats = make([]string, 0, len(availableCategories))
-	}
-
 	if len(cats) == 0 {
-		for c := range availableCategories {
-			cats = append(cats, c)
-		}
+		cats = sortedCategories()
 	}
 
 	r.Categories = cats
 }
+
+// sortedCategories returns all available categories in a stable order
+func sortedCategories() []string {
+	cats := make([]string, 0, len(availableCategories))
+	for c := range availableCategories {
+		cats = append(cats, c)
+	}
+	sort.Strings(cats)
+	return cats
+}
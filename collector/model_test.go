@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 )
 
 func TestCalculateScrapeRequests(t *testing.T) {
@@ -68,6 +69,24 @@ func TestCalculateScrapeRequests(t *testing.T) {
 				{Url: "http://test.com", Strategy: StrategyDesktop, Categories: allCategories},
 				{Url: "http://test.com", Strategy: StrategyMobile, Categories: allCategories},
 			}},
+		{"json with interval",
+			[]string{`{"url":"http://test.com","strategy":"desktop","interval":"15m"}`}, nil, []ScrapeRequest{
+				{Url: "http://test.com", Strategy: StrategyDesktop, Categories: allCategories, Interval: Duration(15 * time.Minute)},
+			}},
+		{"json with schedule",
+			[]string{`{"url":"http://test.com","strategy":"desktop","schedule":"0 9-17 * * 1-5"}`}, nil, []ScrapeRequest{
+				{Url: "http://test.com", Strategy: StrategyDesktop, Categories: allCategories, Schedule: "0 9-17 * * 1-5"},
+			}},
+		{"json with priority",
+			[]string{`{"url":"http://test.com","strategy":"desktop","priority":10}`}, nil, []ScrapeRequest{
+				{Url: "http://test.com", Strategy: StrategyDesktop, Categories: allCategories, Priority: 10},
+			}},
+		{"json with invalid schedule",
+			[]string{`{"url":"http://test.com","strategy":"desktop","schedule":"every day"}`}, nil,
+			[]ScrapeRequest{}},
+		{"json with interval and schedule",
+			[]string{`{"url":"http://test.com","strategy":"desktop","interval":"15m","schedule":"@daily"}`}, nil,
+			[]ScrapeRequest{}},
 		{"json missing URL",
 			[]string{`{"strategy":"desktop"}`}, nil,
 			[]ScrapeRequest{}},
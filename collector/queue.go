@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// hostLimiter counts the running scrapes per host across all queues sharing it, so the limit
+// holds for concurrent collects, the scheduler and probes alike
+type hostLimiter struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	running map[string]int
+	limit   int // 0 does not limit requests per host
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	l := &hostLimiter{running: make(map[string]int), limit: limit}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// scrapeQueue hands out scrape requests ordered by priority. Requests of the same
+// priority alternate between hosts and at most the limit of the host limiter are
+// handed out at a time, so a site with many targets does not starve the others.
+type scrapeQueue struct {
+	ctx     context.Context
+	hosts   *hostLimiter
+	pending []ScrapeRequest
+}
+
+// newScrapeQueue creates a queue of the requests. Once the context is done the requests are handed out
+// regardless of the host limit, so the scrapes fail right away instead of waiting for a free slot.
+func newScrapeQueue(ctx context.Context, requests []ScrapeRequest, hosts *hostLimiter) *scrapeQueue {
+	// the position of a request among the requests of its host interleaves hosts of the same priority
+	ordinals := make([]int, len(requests))
+	perHost := make(map[string]int)
+	for i, r := range requests {
+		ordinals[i] = perHost[requestHost(r)]
+		perHost[requestHost(r)]++
+	}
+
+	indices := make([]int, len(requests))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(a, b int) bool {
+		ra, rb := requests[indices[a]], requests[indices[b]]
+		if ra.Priority != rb.Priority {
+			return ra.Priority > rb.Priority
+		}
+		return ordinals[indices[a]] < ordinals[indices[b]]
+	})
+
+	pending := make([]ScrapeRequest, 0, len(requests))
+	for _, i := range indices {
+		pending = append(pending, requests[i])
+	}
+
+	if hosts == nil {
+		hosts = newHostLimiter(0)
+	}
+	return &scrapeQueue{ctx: ctx, hosts: hosts, pending: pending}
+}
+
+// next returns the first pending request whose host is below the limit. It blocks while
+// all pending hosts are at their limit and returns false once no requests are pending.
+func (q *scrapeQueue) next() (ScrapeRequest, bool) {
+	// wake up the queue when the context is done, even if no slot was freed
+	stop := context.AfterFunc(q.ctx, func() {
+		q.hosts.mutex.Lock()
+		defer q.hosts.mutex.Unlock()
+		q.hosts.cond.Broadcast()
+	})
+	defer stop()
+
+	q.hosts.mutex.Lock()
+	defer q.hosts.mutex.Unlock()
+
+	for len(q.pending) > 0 {
+		for i, r := range q.pending {
+			host := requestHost(r)
+			if q.hosts.limit > 0 && q.hosts.running[host] >= q.hosts.limit && q.ctx.Err() == nil {
+				continue
+			}
+
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.hosts.running[host]++
+			return r, true
+		}
+		q.hosts.cond.Wait()
+	}
+	return ScrapeRequest{}, false
+}
+
+// done marks a request returned by next as finished
+func (q *scrapeQueue) done(r ScrapeRequest) {
+	q.hosts.mutex.Lock()
+	defer q.hosts.mutex.Unlock()
+
+	host := requestHost(r)
+	if q.hosts.running[host]--; q.hosts.running[host] <= 0 {
+		delete(q.hosts.running, host)
+	}
+	q.hosts.cond.Broadcast()
+}
+
+// requestHost returns the host of the request url used to limit concurrent requests
+func requestHost(r ScrapeRequest) string {
+	if u, err := url.Parse(r.Url); err == nil {
+		return u.Host
+	}
+	return r.Url
+}
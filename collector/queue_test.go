@@ -0,0 +1,175 @@
+package collector
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func Test_newScrapeQueueOrder(t *testing.T) {
+	requests := []ScrapeRequest{
+		{Url: "https://a.com/1"},
+		{Url: "https://a.com/2"},
+		{Url: "https://a.com/3"},
+		{Url: "https://b.com/1"},
+		{Url: "https://b.com/2"},
+		{Url: "https://c.com/checkout", Priority: 10},
+	}
+
+	q := newScrapeQueue(context.Background(), requests, nil)
+
+	var got []string
+	for {
+		r, ok := q.next()
+		if !ok {
+			break
+		}
+		got = append(got, r.Url)
+		q.done(r)
+	}
+
+	want := []string{
+		"https://c.com/checkout",
+		"https://a.com/1",
+		"https://b.com/1",
+		"https://a.com/2",
+		"https://b.com/2",
+		"https://a.com/3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queue order = %v, want %v", got, want)
+	}
+}
+
+func Test_scrapeQueueHostLimit(t *testing.T) {
+	var requests []ScrapeRequest
+	for i := 0; i < 10; i++ {
+		requests = append(requests, ScrapeRequest{Url: "https://a.com/"}, ScrapeRequest{Url: "https://b.com/"})
+	}
+	q := newScrapeQueue(context.Background(), requests, newHostLimiter(2))
+
+	running := map[string]int{}
+	next := func() ScrapeRequest {
+		t.Helper()
+		r, ok := q.next()
+		if !ok {
+			t.Fatal("next() should return a pending request")
+		}
+		if running[requestHost(r)]++; running[requestHost(r)] > 2 {
+			t.Errorf("%d concurrent requests for host %s, want at most 2", running[requestHost(r)], requestHost(r))
+		}
+		return r
+	}
+	done := func(r ScrapeRequest) {
+		running[requestHost(r)]--
+		q.done(r)
+	}
+
+	var taken []ScrapeRequest
+	for i := 0; i < 4; i++ {
+		taken = append(taken, next())
+	}
+
+	// queues sharing the limiter, e.g. of concurrent collects, skip the hosts at their limit as well
+	other := newScrapeQueue(context.Background(), []ScrapeRequest{{Url: "https://a.com/"}, {Url: "https://c.com/"}}, q.hosts)
+	if r, _ := other.next(); requestHost(r) != "c.com" {
+		t.Errorf("next() of another queue = %s, want the request of the host below the limit", r.Url)
+	}
+
+	// a.com is at its limit, so the next request of b.com is handed out first once it has a free slot
+	done(taken[1])
+	if r := next(); requestHost(r) != "b.com" {
+		t.Errorf("next() = %s, want the request of the host with a free slot", r.Url)
+	}
+
+	for _, r := range []ScrapeRequest{taken[0], taken[2], taken[3]} {
+		done(r)
+	}
+	for n := 5; n < len(requests); n++ {
+		done(next())
+	}
+}
+
+func Test_scrapeQueueCanceled(t *testing.T) {
+	hosts := newHostLimiter(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	q := newScrapeQueue(ctx, []ScrapeRequest{{Url: "https://a.com/1"}, {Url: "https://a.com/2"}}, hosts)
+	if _, ok := q.next(); !ok {
+		t.Fatal("next() should return the first request")
+	}
+
+	next := make(chan bool)
+	go func() {
+		_, ok := q.next()
+		next <- ok
+	}()
+
+	select {
+	case <-next:
+		t.Fatal("next() should wait while the host is at its limit")
+	default:
+	}
+
+	// no slot is freed, only canceling the context releases the pending request
+	cancel()
+	if ok := <-next; !ok {
+		t.Error("next() should return the pending request once the context is done")
+	}
+}
+
+func Test_PagespeedScrapeServiceHostLimit(t *testing.T) {
+	var (
+		mutex            sync.Mutex
+		running, maxSeen int
+	)
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	service, err := newPagespeedScrapeService(scrapeServiceConfig{
+		concurrency:     4,
+		hostConcurrency: 1,
+		backend: backendFunc(func(ctx context.Context, request ScrapeRequest) (*Result, error) {
+			mutex.Lock()
+			running++
+			maxSeen = max(maxSeen, running)
+			mutex.Unlock()
+
+			// hold the slot of the host until the test releases it
+			entered <- struct{}{}
+			<-release
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return &Result{}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("newPagespeedScrapeService should not throw an error: %v", err)
+	}
+
+	// concurrent collects of the same service share the limit
+	requests := CalculateScrapeRequests([]string{"https://a.com/"}, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = service.Scrape(context.Background(), requests)
+		}()
+	}
+	for i := 0; i < 4*len(requests); i++ {
+		<-entered
+		mutex.Lock()
+		if running != 1 {
+			t.Errorf("%d concurrent requests for the host, want at most 1 across all scrapes", running)
+		}
+		mutex.Unlock()
+		release <- struct{}{}
+	}
+	wg.Wait()
+
+	if maxSeen != 1 {
+		t.Errorf("%d concurrent requests for the host, want at most 1 across all scrapes", maxSeen)
+	}
+}
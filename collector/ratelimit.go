@@ -0,0 +1,198 @@
+package collector
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ prometheus.Collector = &RateLimiter{}
+
+// RateLimits configures the request budgets for the PageSpeed Insights API, 0 disables a budget
+type RateLimits struct {
+	PerSecond int
+	PerMinute int
+	PerDay    int
+}
+
+// RateLimiter is a token bucket rate limiter shared by all scrapes against the API.
+// Requests exceeding a budget wait until enough tokens are refilled.
+type RateLimiter struct {
+	buckets []*tokenBucket
+	mutex   sync.Mutex
+
+	waiting   int
+	throttled float64
+	waited    time.Duration
+
+	remainingDesc *prometheus.Desc
+	waitingDesc   *prometheus.Desc
+	throttledDesc *prometheus.Desc
+	waitedDesc    *prometheus.Desc
+}
+
+// tokenBucket holds up to capacity tokens and refills them continuously over the window.
+// A daily bucket is refilled at once when the quota day of the API starts, like its daily quota.
+type tokenBucket struct {
+	window   string
+	capacity float64
+	rate     float64 // tokens per second
+	daily    bool
+	tokens   float64
+	updated  time.Time
+}
+
+// NewRateLimiter creates a limiter for the given budgets. It returns nil,
+// which does not limit at all, if no budget is configured.
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	now := time.Now()
+	var buckets []*tokenBucket
+	for _, b := range []struct {
+		window string
+		limit  int
+		period time.Duration
+	}{
+		{"second", limits.PerSecond, time.Second},
+		{"minute", limits.PerMinute, time.Minute},
+		{"day", limits.PerDay, 24 * time.Hour},
+	} {
+		if b.limit <= 0 {
+			continue
+		}
+		buckets = append(buckets, &tokenBucket{
+			window:   b.window,
+			capacity: float64(b.limit),
+			rate:     float64(b.limit) / b.period.Seconds(),
+			daily:    b.period == 24*time.Hour,
+			tokens:   float64(b.limit),
+			updated:  now,
+		})
+	}
+
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	return &RateLimiter{
+		buckets:       buckets,
+		remainingDesc: prometheus.NewDesc(fqname("ratelimit_remaining"), "Remaining requests in the rate limit budget of the window", []string{"window"}, nil),
+		waitingDesc:   prometheus.NewDesc(fqname("ratelimit_waiting_requests"), "Requests currently waiting for the rate limiter", nil, nil),
+		throttledDesc: prometheus.NewDesc(fqname("ratelimit_throttled_total"), "Total requests which had to wait for the rate limiter", nil, nil),
+		waitedDesc:    prometheus.NewDesc(fqname("ratelimit_wait_seconds_total"), "Total time requests waited for the rate limiter", nil, nil),
+	}
+}
+
+// Wait blocks until a request fits into all budgets or the context is done
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	start := time.Now()
+	throttled := false
+	defer func() {
+		if throttled {
+			l.mutex.Lock()
+			l.waiting--
+			l.throttled++
+			l.waited += time.Since(start)
+			l.mutex.Unlock()
+		}
+	}()
+
+	for {
+		l.mutex.Lock()
+		delay := l.reserve(time.Now())
+		if delay > 0 && !throttled {
+			throttled = true
+			l.waiting++
+		}
+		l.mutex.Unlock()
+
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes a token from every bucket if all have one available, otherwise
+// it returns the time until they will. The mutex must be held.
+func (l *RateLimiter) reserve(now time.Time) time.Duration {
+	var delay time.Duration
+	for _, b := range l.buckets {
+		b.refill(now)
+		if b.tokens < 1 {
+			if d := b.until(now); d > delay {
+				delay = d
+			}
+		}
+	}
+
+	if delay > 0 {
+		return delay
+	}
+
+	for _, b := range l.buckets {
+		b.tokens--
+	}
+	return 0
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.daily {
+		if quotaDay(now).After(quotaDay(b.updated)) {
+			b.tokens = b.capacity
+		}
+		if now.After(b.updated) {
+			b.updated = now
+		}
+		return
+	}
+
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.rate)
+		b.updated = now
+	}
+}
+
+// until returns the time until the bucket has a token again
+func (b *tokenBucket) until(now time.Time) time.Duration {
+	if b.daily {
+		return quotaDay(now).AddDate(0, 0, 1).Sub(now)
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second)))
+}
+
+// Describe implements prometheus.Collector.
+func (l *RateLimiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.remainingDesc
+	ch <- l.waitingDesc
+	ch <- l.throttledDesc
+	ch <- l.waitedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (l *RateLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for _, b := range l.buckets {
+		b.refill(now)
+		ch <- prometheus.MustNewConstMetric(l.remainingDesc, prometheus.GaugeValue, math.Floor(b.tokens), b.window)
+	}
+	ch <- prometheus.MustNewConstMetric(l.waitingDesc, prometheus.GaugeValue, float64(l.waiting))
+	ch <- prometheus.MustNewConstMetric(l.throttledDesc, prometheus.CounterValue, l.throttled)
+	ch <- prometheus.MustNewConstMetric(l.waitedDesc, prometheus.CounterValue, l.waited.Seconds())
+}
@@ -0,0 +1,117 @@
+package collector
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	if l := NewRateLimiter(RateLimits{}); l != nil {
+		t.Error("NewRateLimiter() without budgets should return nil")
+	}
+
+	var l *RateLimiter
+	if err := l.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() on nil limiter returned error %v", err)
+	}
+}
+
+func TestRateLimiter_reserve(t *testing.T) {
+	l := NewRateLimiter(RateLimits{PerSecond: 2, PerMinute: 3})
+	now := l.buckets[0].updated
+
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(now); d != 0 {
+			t.Fatalf("reserve() #%d = %v, want no delay within the budget", i, d)
+		}
+	}
+
+	if d := l.reserve(now); d != 500*time.Millisecond {
+		t.Errorf("reserve() exceeding the second budget = %v, want 500ms", d)
+	}
+
+	now = now.Add(time.Second)
+	if d := l.reserve(now); d != 0 {
+		t.Errorf("reserve() after refill = %v, want no delay", d)
+	}
+
+	if d := l.reserve(now); d != 19*time.Second {
+		t.Errorf("reserve() exceeding the minute budget = %v, want 19s", d)
+	}
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	l := NewRateLimiter(RateLimits{PerSecond: 20})
+	for i := 0; i < 20; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Wait() returned after %v, want to wait for a refill", waited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 20; i++ {
+		if err := l.Wait(ctx); err != nil {
+			return
+		}
+	}
+	t.Error("Wait() should fail when the context is done before a token is available")
+}
+
+func TestRateLimiter_reserveDay(t *testing.T) {
+	l := NewRateLimiter(RateLimits{PerDay: 2})
+	now := time.Date(2024, 11, 4, 23, 0, 0, 0, quotaLocation)
+	l.buckets[0].updated = now
+
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(now); d != 0 {
+			t.Fatalf("reserve() #%d = %v, want no delay within the budget", i, d)
+		}
+	}
+
+	// the budget is not refilled over the day, but at midnight pacific time
+	now = now.Add(30 * time.Minute)
+	if d := l.reserve(now); d != 30*time.Minute {
+		t.Errorf("reserve() exceeding the day budget = %v, want 30m until the quota day ends", d)
+	}
+
+	now = now.Add(30 * time.Minute)
+	for i := 0; i < 2; i++ {
+		if d := l.reserve(now); d != 0 {
+			t.Fatalf("reserve() #%d on the next quota day = %v, want the budget to be reset", i, d)
+		}
+	}
+	if d := l.reserve(now); d != 24*time.Hour {
+		t.Errorf("reserve() exceeding the day budget = %v, want 24h", d)
+	}
+}
+
+func TestRateLimiter_Collect(t *testing.T) {
+	l := NewRateLimiter(RateLimits{PerDay: 100})
+	l.buckets[0].tokens = 42
+	l.throttled = 3
+
+	expected := `
+# HELP pagespeed_ratelimit_remaining Remaining requests in the rate limit budget of the window
+# TYPE pagespeed_ratelimit_remaining gauge
+pagespeed_ratelimit_remaining{window="day"} 42
+# HELP pagespeed_ratelimit_throttled_total Total requests which had to wait for the rate limiter
+# TYPE pagespeed_ratelimit_throttled_total counter
+pagespeed_ratelimit_throttled_total 3
+`
+	if err := testutil.CollectAndCompare(l, strings.NewReader(expected), "pagespeed_ratelimit_remaining", "pagespeed_ratelimit_throttled_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// runPagespeedPath is the path of the PageSpeed Insights API method running lighthouse
+const runPagespeedPath = "/pagespeedonline/v5/runPagespeed"
+
+// unsafeFileChars are replaced in the host part of recording file names
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// recordTransport records the raw PageSpeed Insights API responses to a directory, or replays them
+// from it without calling the API. Other requests, e.g. to the CrUX APIs, are passed to the next transport.
+type recordTransport struct {
+	next   http.RoundTripper
+	dir    string
+	replay bool
+}
+
+// newRecordTransport creates a transport recording responses of the next transport to the directory,
+// or replaying them from it. It creates the directory for recording.
+func newRecordTransport(next http.RoundTripper, dir string, replay bool) (*recordTransport, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	if !replay {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, errors.Wrap(err, "could not create record directory")
+		}
+	}
+	return &recordTransport{next: next, dir: dir, replay: replay}, nil
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, runPagespeedPath) {
+		return t.next.RoundTrip(req)
+	}
+
+	path := filepath.Join(t.dir, recordFileName(req.URL.Query()))
+	if t.replay {
+		return t.replayResponse(req, path)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		// errors are not recorded, so they don't replace a successful recording
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := writeRecording(path, body); err != nil {
+		log.WithError(err).WithField("file", path).Warn("could not record pagespeed response")
+	}
+	return resp, nil
+}
+
+// replayResponse answers the request with the recording in the file, or an API error if there is none
+func (t *recordTransport) replayResponse(req *http.Request, path string) (*http.Response, error) {
+	status := http.StatusOK
+	body, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "could not read recording")
+		}
+
+		status = http.StatusNotFound
+		body, _ = json.Marshal(map[string]any{"error": map[string]any{
+			"code":    status,
+			"message": fmt.Sprintf("no recorded response for %s in %s", req.URL.Query().Get("url"), t.dir),
+		}})
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json; charset=UTF-8"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// recordFileName returns the name of the recording of a request with the query. Equivalent requests share
+// the name like the cache key, the host and strategy make it recognizable, and the API key is not part of it.
+func recordFileName(query url.Values) string {
+	request := ScrapeRequest{
+		Url:        query.Get("url"),
+		Strategy:   Strategy(query.Get("strategy")),
+		Campaign:   query.Get("utm_campaign"),
+		Source:     query.Get("utm_source"),
+		Locale:     query.Get("locale"),
+		Categories: query["category"],
+	}
+
+	host := "invalid"
+	if u, err := url.Parse(normalizeURL(request.Url)); err == nil && u.Host != "" {
+		host = unsafeFileChars.ReplaceAllString(u.Host, "_")
+	}
+	return fmt.Sprintf("%s-%s-%s.json", host, request.Strategy, hex.EncodeToString([]byte(cacheKeyFromRequest(request)))[:16])
+}
+
+// writeRecording writes the body to a temporary file renamed to the recording,
+// so a replay never reads a partially written recording
+func writeRecording(path string, body []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), cacheTmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,124 @@
+package collector
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_recordFileName(t *testing.T) {
+	name := recordFileName(url.Values{"url": {"https://www.example.com/"}, "strategy": {"mobile"}, "category": {"performance", "seo"}, "key": {"KEY"}})
+	if !strings.HasPrefix(name, "www.example.com-mobile-") || !strings.HasSuffix(name, ".json") {
+		t.Errorf("recordFileName() = %s, want the host and strategy in the name", name)
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		same  bool
+	}{
+		{name: "other key", query: url.Values{"url": {"https://www.example.com/"}, "strategy": {"mobile"}, "category": {"performance", "seo"}, "key": {"OTHER"}}, same: true},
+		{name: "equivalent url and category order", query: url.Values{"url": {"HTTPS://www.example.com:443"}, "strategy": {"mobile"}, "category": {"seo", "performance"}}, same: true},
+		{name: "other strategy", query: url.Values{"url": {"https://www.example.com/"}, "strategy": {"desktop"}, "category": {"performance", "seo"}}},
+		{name: "other categories", query: url.Values{"url": {"https://www.example.com/"}, "strategy": {"mobile"}, "category": {"performance"}}},
+		{name: "locale", query: url.Values{"url": {"https://www.example.com/"}, "strategy": {"mobile"}, "category": {"performance", "seo"}, "locale": {"de"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recordFileName(tt.query); (got == name) != tt.same {
+				t.Errorf("recordFileName() = %s, want same name as %s %v", got, name, tt.same)
+			}
+		})
+	}
+}
+
+func Test_recordReplay(t *testing.T) {
+	// the fixture of the fake API in psitest, which imports this package and can't be imported here
+	fixture, err := os.ReadFile(filepath.Join("..", "psitest", "fixture.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") == "https://www.example.com/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":{"code":500,"message":"Lighthouse returned error: NO_FCP"}}`))
+			return
+		}
+		_, _ = w.Write(fixture)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	config := Config{
+		ScrapeRequests: []ScrapeRequest{
+			{Url: "https://www.example.com/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance, CategorySEO}},
+			{Url: "https://www.example.com/broken", Strategy: StrategyMobile, Categories: []string{CategoryPerformance, CategorySEO}},
+		},
+	}
+
+	recording, err := NewFactory(WithEndpoint(server.URL), WithRecording(dir)).Create(Config{GoogleAPIKey: "KEY", ScrapeRequests: config.ScrapeRequests})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+	if n := testutil.CollectAndCount(recording, "pagespeed_up"); n != 2 {
+		t.Fatalf("recording collector reported %d targets, want 2", n)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("recorded %d files, want only the successful response", len(files))
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, files[0].Name())); !bytes.Equal(b, fixture) {
+		t.Errorf("recorded response differs from the raw response of the API")
+	}
+	server.Close()
+
+	// replays without a key, the endpoint does not exist, and the rate limit of the API does not apply
+	config.ScrapeTimeout = 5 * time.Second
+	replaying, err := NewFactory(
+		WithEndpoint("http://psi.invalid/"),
+		WithReplay(dir),
+		WithRateLimiter(NewRateLimiter(RateLimits{PerDay: 1})),
+		WithRetryPolicy(NewRetryPolicy(3, time.Millisecond, time.Millisecond)),
+	).Create(config)
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+
+	expected := `
+# HELP pagespeed_lighthouse_category_score Lighthouse score for the specified category
+# TYPE pagespeed_lighthouse_category_score gauge
+pagespeed_lighthouse_category_score{category="performance",host="https://www.example.com",path="/",strategy="mobile"} 0.91
+pagespeed_lighthouse_category_score{category="seo",host="https://www.example.com",path="/",strategy="mobile"} 0.8
+# HELP pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds Percentile metrics for largest contentful paint
+# TYPE pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds gauge
+pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds{host="https://www.example.com",path="/",strategy="mobile"} 2.612
+# HELP pagespeed_scrape_target_error Set to 1 with the error class if the last scrape of the target failed
+# TYPE pagespeed_scrape_target_error gauge
+pagespeed_scrape_target_error{class="http",host="https://www.example.com",path="/broken",strategy="mobile"} 1
+# HELP pagespeed_up Whether the last scrape of the target was successful (1) or not (0)
+# TYPE pagespeed_up gauge
+pagespeed_up{host="https://www.example.com",path="/",strategy="mobile"} 1
+pagespeed_up{host="https://www.example.com",path="/broken",strategy="mobile"} 0
+`
+	if err := testutil.CollectAndCompare(replaying, strings.NewReader(expected),
+		"pagespeed_lighthouse_category_score",
+		"pagespeed_loading_experience_metrics_largest_contentful_paint_duration_seconds",
+		"pagespeed_scrape_target_error",
+		"pagespeed_up",
+	); err != nil {
+		t.Error(err)
+	}
+}
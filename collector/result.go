@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/pagespeedonline/v5"
+)
+
+// Result holds the parts of a PageSpeed Insights response exported by the collector.
+// It is extracted right after the API call, so screenshots and other large payloads
+// of the response are not kept in memory or in the cache.
+type Result struct {
+	LoadingExperience       *LoadingExperience `json:"loadingExperience,omitempty"`
+	OriginLoadingExperience *LoadingExperience `json:"originLoadingExperience,omitempty"`
+	Lighthouse              *LighthouseResult  `json:"lighthouse,omitempty"`
+
+	LoadingExperienceHistory       *LoadingExperienceHistory `json:"loadingExperienceHistory,omitempty"`
+	OriginLoadingExperienceHistory *LoadingExperienceHistory `json:"originLoadingExperienceHistory,omitempty"`
+}
+
+// LoadingExperience are the CrUX metrics of real users for a page or its origin
+type LoadingExperience struct {
+	OverallCategory string                `json:"overallCategory,omitempty"`
+	Metrics         map[string]CrUXMetric `json:"metrics,omitempty"` // keyed by CrUX metric key
+}
+
+// LoadingExperienceHistory are the CrUX metrics of real users in weekly collection periods of 28 days
+type LoadingExperienceHistory struct {
+	PeriodEnds []time.Time              `json:"periodEnds"`        // last day of each collection period, oldest first
+	Metrics    map[string][]*CrUXMetric `json:"metrics,omitempty"` // keyed by CrUX metric key, one per period, nil without data
+}
+
+// CrUXMetric is the 75th percentile of a CrUX metric and its histogram in the units of the API
+type CrUXMetric struct {
+	Percentile    float64  `json:"percentile"`
+	Distributions []Bucket `json:"distributions,omitempty"` // fast, average and slow page loads
+}
+
+// Bucket is a range of a CrUX histogram and the proportion of page loads within it
+type Bucket struct {
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max,omitempty"` // 0 for the open-ended last bucket
+	Proportion float64 `json:"proportion"`
+}
+
+// LighthouseResult are the lab metrics of a Lighthouse run
+type LighthouseResult struct {
+	TotalDuration float64            `json:"totalDuration"`        // in milliseconds
+	Categories    map[string]float64 `json:"categories,omitempty"` // scores keyed by category, unscored categories are missing
+	Audits        map[string]Audit   `json:"audits,omitempty"`     // keyed by audit id
+}
+
+// Audit is the result of a Lighthouse audit
+type Audit struct {
+	Score        *float64 `json:"score,omitempty"` // nil if the audit is not scored
+	NumericValue float64  `json:"numericValue,omitempty"`
+	NumericUnit  string   `json:"numericUnit,omitempty"` // empty if the audit has no numeric value
+	Categories   []string `json:"categories,omitempty"`  // categories referencing the audit
+}
+
+// newResult extracts the exported parts of a PageSpeed Insights response
+func newResult(r *pagespeedonline.PagespeedApiPagespeedResponseV5) *Result {
+	return &Result{
+		LoadingExperience:       newLoadingExperience(r.LoadingExperience),
+		OriginLoadingExperience: newLoadingExperience(r.OriginLoadingExperience),
+		Lighthouse:              newLighthouseResult(r.LighthouseResult),
+	}
+}
+
+func newLoadingExperience(lexp *pagespeedonline.PagespeedApiLoadingExperienceV5) *LoadingExperience {
+	if lexp == nil {
+		return nil
+	}
+
+	l := &LoadingExperience{
+		OverallCategory: lexp.OverallCategory,
+		Metrics:         make(map[string]CrUXMetric, len(lexp.Metrics)),
+	}
+	for k, m := range lexp.Metrics {
+		metric := CrUXMetric{Percentile: float64(m.Percentile)}
+		for _, b := range m.Distributions {
+			if b == nil {
+				continue
+			}
+			metric.Distributions = append(metric.Distributions, Bucket{Min: float64(b.Min), Max: float64(b.Max), Proportion: b.Proportion})
+		}
+		l.Metrics[k] = metric
+	}
+	return l
+}
+
+func newLighthouseResult(lhr *pagespeedonline.LighthouseResultV5) *LighthouseResult {
+	if lhr == nil {
+		return nil
+	}
+
+	l := &LighthouseResult{
+		Categories: make(map[string]float64),
+		Audits:     make(map[string]Audit, len(lhr.Audits)),
+	}
+
+	if lhr.Timing != nil {
+		l.TotalDuration = lhr.Timing.Total
+	}
+
+	auditCategories := map[string][]string{}
+	for name, c := range lighthouseCategories(lhr.Categories) {
+		if c == nil {
+			continue
+		}
+		if score, ok := parseScore(c.Score); ok {
+			l.Categories[name] = score
+		}
+		for _, ref := range c.AuditRefs {
+			if ref != nil {
+				auditCategories[ref.Id] = append(auditCategories[ref.Id], name)
+			}
+		}
+	}
+
+	for k, a := range lhr.Audits {
+		audit := Audit{NumericValue: a.NumericValue, NumericUnit: a.NumericUnit, Categories: auditCategories[k]}
+		if score, ok := parseScore(a.Score); ok {
+			audit.Score = &score
+		}
+		if audit.Categories != nil {
+			slices.Sort(audit.Categories)
+		}
+		l.Audits[k] = audit
+	}
+	return l
+}
+
+// forCategories returns a copy of the lighthouse result limited to the categories and their
+// audits. Audits which are not part of any category are kept, the API returns them for all.
+func (l *LighthouseResult) forCategories(categories []string) *LighthouseResult {
+	filtered := &LighthouseResult{
+		TotalDuration: l.TotalDuration,
+		Categories:    make(map[string]float64, len(categories)),
+		Audits:        make(map[string]Audit, len(l.Audits)),
+	}
+	for _, c := range categories {
+		if score, ok := l.Categories[c]; ok {
+			filtered.Categories[c] = score
+		}
+	}
+	for k, a := range l.Audits {
+		if len(a.Categories) == 0 || slices.ContainsFunc(a.Categories, func(c string) bool { return slices.Contains(categories, c) }) {
+			filtered.Audits[k] = a
+		}
+	}
+	return filtered
+}
+
+// lighthouseCategories maps the categories of a lighthouse result by their name
+func lighthouseCategories(c *pagespeedonline.Categories) map[string]*pagespeedonline.LighthouseCategoryV5 {
+	if c == nil {
+		return nil
+	}
+	return map[string]*pagespeedonline.LighthouseCategoryV5{
+		CategoryPerformance:   c.Performance,
+		CategoryAccessibility: c.Accessibility,
+		CategoryBestPractices: c.BestPractices,
+		CategorySEO:           c.Seo,
+	}
+}
+
+// parseScore returns the score of a category or audit, which is null if not scored
+func parseScore(score interface{}) (float64, bool) {
+	if score == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(fmt.Sprint(score), 64)
+	return value, err == nil
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/api/pagespeedonline/v5"
+)
+
+func Test_newResult(t *testing.T) {
+	response := &pagespeedonline.PagespeedApiPagespeedResponseV5{
+		LoadingExperience: &pagespeedonline.PagespeedApiLoadingExperienceV5{
+			OverallCategory: "FAST",
+			Metrics: map[string]pagespeedonline.UserPageLoadMetricV5{
+				"LARGEST_CONTENTFUL_PAINT_MS": {
+					Percentile: 1278,
+					Category:   "FAST",
+					Distributions: []*pagespeedonline.Bucket{
+						{Min: 0, Max: 2500, Proportion: 0.9389},
+						{Min: 2500, Max: 4000, Proportion: 0.0371},
+						{Min: 4000, Proportion: 0.024},
+					},
+				},
+			},
+		},
+		LighthouseResult: &pagespeedonline.LighthouseResultV5{
+			Timing: &pagespeedonline.Timing{Total: 12500},
+			Categories: &pagespeedonline.Categories{
+				Performance: &pagespeedonline.LighthouseCategoryV5{Score: 0.91, Title: "Performance"},
+				Seo:         &pagespeedonline.LighthouseCategoryV5{Score: nil},
+			},
+			Audits: map[string]pagespeedonline.LighthouseAuditResultV5{
+				"first-contentful-paint": {NumericValue: 1234.5, NumericUnit: "millisecond", Score: 0.98, DisplayValue: "1,2 s"},
+				"final-screenshot":       {Details: []byte(`{"data":"data:image/jpeg;base64,..."}`)},
+			},
+		},
+	}
+
+	score := 0.98
+	want := &Result{
+		LoadingExperience: &LoadingExperience{
+			OverallCategory: "FAST",
+			Metrics: map[string]CrUXMetric{
+				"LARGEST_CONTENTFUL_PAINT_MS": {
+					Percentile: 1278,
+					Distributions: []Bucket{
+						{Min: 0, Max: 2500, Proportion: 0.9389},
+						{Min: 2500, Max: 4000, Proportion: 0.0371},
+						{Min: 4000, Proportion: 0.024},
+					},
+				},
+			},
+		},
+		Lighthouse: &LighthouseResult{
+			TotalDuration: 12500,
+			Categories:    map[string]float64{CategoryPerformance: 0.91},
+			Audits: map[string]Audit{
+				"first-contentful-paint": {Score: &score, NumericValue: 1234.5, NumericUnit: "millisecond"},
+				"final-screenshot":       {},
+			},
+		},
+	}
+
+	if got := newResult(response); !reflect.DeepEqual(got, want) {
+		t.Errorf("newResult() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLighthouseResult_forCategories(t *testing.T) {
+	lhr := newLighthouseResult(&pagespeedonline.LighthouseResultV5{
+		Categories: &pagespeedonline.Categories{
+			Performance: &pagespeedonline.LighthouseCategoryV5{Score: 0.91, AuditRefs: []*pagespeedonline.AuditRefs{{Id: "first-contentful-paint"}, {Id: "shared"}}},
+			Seo:         &pagespeedonline.LighthouseCategoryV5{Score: 0.8, AuditRefs: []*pagespeedonline.AuditRefs{{Id: "document-title"}, {Id: "shared"}}},
+		},
+		Audits: map[string]pagespeedonline.LighthouseAuditResultV5{
+			"first-contentful-paint": {Score: 0.98},
+			"document-title":         {Score: 1},
+			"shared":                 {Score: 1},
+			"final-screenshot":       {},
+		},
+	})
+
+	got := lhr.forCategories([]string{CategoryPerformance})
+
+	if !reflect.DeepEqual(got.Categories, map[string]float64{CategoryPerformance: 0.91}) {
+		t.Errorf("categories = %v, want performance only", got.Categories)
+	}
+	var audits []string
+	for k := range got.Audits {
+		audits = append(audits, k)
+	}
+	sort.Strings(audits)
+	if want := []string{"final-screenshot", "first-contentful-paint", "shared"}; !reflect.DeepEqual(audits, want) {
+		t.Errorf("audits = %v, want %v", audits, want)
+	}
+	if len(lhr.Audits) != 4 {
+		t.Error("forCategories should not modify the result")
+	}
+}
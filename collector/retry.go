@@ -0,0 +1,152 @@
+package collector
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+var _ prometheus.Collector = &RetryPolicy{}
+
+// RetryPolicy retries retryable API errors with exponential backoff and jitter
+// and counts the retries per target.
+type RetryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+
+	retries map[retryKey]float64
+	mutex   sync.Mutex
+
+	retriesDesc *prometheus.Desc
+}
+
+type retryKey struct {
+	url      string
+	strategy Strategy
+	class    ErrorClass
+}
+
+// NewRetryPolicy creates a policy retrying up to maxRetries times. The delay doubles
+// from baseDelay with every attempt up to maxDelay. It returns nil, which does not
+// retry at all, if maxRetries is 0.
+func NewRetryPolicy(maxRetries int, baseDelay, maxDelay time.Duration) *RetryPolicy {
+	if maxRetries <= 0 {
+		return nil
+	}
+
+	return &RetryPolicy{
+		maxRetries:  maxRetries,
+		baseDelay:   baseDelay,
+		maxDelay:    maxDelay,
+		retries:     make(map[retryKey]float64),
+		retriesDesc: prometheus.NewDesc(fqname("scrape_target_retries_total"), "Total retries of failed scrapes of the target by error class", append(append([]string{}, targetLabels...), "class"), nil),
+	}
+}
+
+// do calls fn until it succeeds, returns a permanent error or the retries are exhausted.
+// It does not retry if the delay exceeds the deadline of the context.
+func (p *RetryPolicy) do(ctx context.Context, request ScrapeRequest, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || p == nil || attempt >= p.maxRetries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		class := classifyError(err)
+		delay := p.delay(attempt, err)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			// the retry would not return before the deadline, e.g. of a probe
+			return err
+		}
+		log.WithError(err).WithFields(log.Fields{
+			"target":   request.Url,
+			"strategy": request.Strategy,
+			"class":    class,
+			"attempt":  attempt + 1,
+			"delay":    delay,
+		}).Info("retrying failed scrape")
+
+		p.mutex.Lock()
+		p.retries[retryKey{url: request.Url, strategy: request.Strategy, class: class}]++
+		p.mutex.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns the exponential backoff with full jitter for the attempt,
+// or the delay requested by the server if it is longer
+func (p *RetryPolicy) delay(attempt int, err error) time.Duration {
+	backoff := p.maxDelay
+	if shift := uint(attempt); shift < 32 {
+		backoff = p.baseDelay << shift
+	}
+	// the shift overflows for large attempts or base delays
+	if backoff <= 0 || backoff > p.maxDelay {
+		backoff = p.maxDelay
+	}
+	if backoff > 0 {
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	}
+
+	if retryAfter := retryAfter(err); retryAfter > backoff {
+		return retryAfter
+	}
+	return backoff
+}
+
+// retryAfter returns the delay of a Retry-After header of an API error
+func retryAfter(err error) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0
+	}
+
+	value := apiErr.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, errParse := strconv.Atoi(value); errParse == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, errParse := http.ParseTime(value); errParse == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// Describe implements prometheus.Collector.
+func (p *RetryPolicy) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.retriesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (p *RetryPolicy) Collect(ch chan<- prometheus.Metric) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for k, v := range p.retries {
+		constLabels, err := getConstLabels(&ScrapeResult{Request: ScrapeRequest{Url: k.url, Strategy: k.strategy}})
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(p.retriesDesc, prometheus.CounterValue, v, withLabels(targetLabelValues(constLabels), string(k.class))...)
+	}
+}
@@ -0,0 +1,111 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryPolicy_do(t *testing.T) {
+	request := ScrapeRequest{Url: "https://host/path", Strategy: StrategyMobile}
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	badRequest := &googleapi.Error{Code: http.StatusBadRequest}
+
+	tests := []struct {
+		name      string
+		policy    *RetryPolicy
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"nil policy", nil, []error{unavailable}, 1, unavailable},
+		{"success", NewRetryPolicy(2, time.Millisecond, time.Millisecond), []error{nil}, 1, nil},
+		{"transient", NewRetryPolicy(2, time.Millisecond, time.Millisecond), []error{unavailable, unavailable, nil}, 3, nil},
+		{"exhausted", NewRetryPolicy(2, time.Millisecond, time.Millisecond), []error{unavailable, unavailable, unavailable}, 3, unavailable},
+		{"permanent", NewRetryPolicy(2, time.Millisecond, time.Millisecond), []error{badRequest, nil}, 1, badRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := tt.policy.do(context.Background(), request, func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if err != tt.wantErr {
+				t.Errorf("do() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("do() called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_doDeadline(t *testing.T) {
+	p := NewRetryPolicy(2, time.Minute, time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	err := p.do(ctx, ScrapeRequest{Url: "https://host/path"}, func() error {
+		calls++
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("do() = %v after %d calls, want the error without a retry", err, calls)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("do() returned after %v, want no wait for a retry past the deadline", d)
+	}
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+	p := NewRetryPolicy(5, time.Second, 10*time.Second)
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if d := p.delay(attempt, nil); d < max/2 || d > max {
+			t.Errorf("delay(%d) = %v, want between %v and %v", attempt, d, max/2, max)
+		}
+	}
+
+	for _, p := range []*RetryPolicy{NewRetryPolicy(100, time.Second, 10*time.Second), NewRetryPolicy(5, time.Duration(1)<<62, time.Duration(1)<<62+1)} {
+		for attempt := 0; attempt < 100; attempt++ {
+			if d := p.delay(attempt, nil); d < 0 || d > p.maxDelay {
+				t.Fatalf("delay(%d) = %v, want between 0 and %v", attempt, d, p.maxDelay)
+			}
+		}
+	}
+
+	err := &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"30"}}}
+	if d := p.delay(0, err); d != 30*time.Second {
+		t.Errorf("delay() with Retry-After = %v, want 30s", d)
+	}
+}
+
+func TestRetryPolicy_Collect(t *testing.T) {
+	p := NewRetryPolicy(1, time.Millisecond, time.Millisecond)
+	request := ScrapeRequest{Url: "https://host/path", Strategy: StrategyMobile}
+	calls := 0
+	_ = p.do(context.Background(), request, func() error {
+		calls++
+		if calls == 1 {
+			return &googleapi.Error{Code: http.StatusTooManyRequests}
+		}
+		return nil
+	})
+
+	expected := `
+# HELP pagespeed_scrape_target_retries_total Total retries of failed scrapes of the target by error class
+# TYPE pagespeed_scrape_target_retries_total counter
+pagespeed_scrape_target_retries_total{class="quota",host="https://host",path="/path",strategy="mobile"} 1
+`
+	if err := testutil.CollectAndCompare(p, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
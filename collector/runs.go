@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"math"
+	"sort"
+)
+
+// RunStats summarizes the lighthouse values of several runs of a target
+type RunStats struct {
+	Count      int              // number of successful runs
+	Categories map[string]Stats // category scores keyed by category
+	Audits     map[string]Stats // audit scores keyed by audit
+	Numeric    map[string]Stats // audit numeric values keyed by audit, in the numericUnit of the audit
+}
+
+// Stats describes the distribution of a value over several runs
+type Stats struct {
+	Median float64
+	Min    float64
+	Max    float64
+	StdDev float64
+}
+
+// newStats calculates the stats of at least one value
+func newStats(values []float64) Stats {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	median := sorted[n/2]
+	if n%2 == 0 {
+		median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(n)
+
+	var squares float64
+	for _, v := range sorted {
+		squares += (v - mean) * (v - mean)
+	}
+
+	return Stats{
+		Median: median,
+		Min:    sorted[0],
+		Max:    sorted[n-1],
+		StdDev: math.Sqrt(squares / float64(n)),
+	}
+}
+
+// aggregateRuns combines the results of several runs of a target. The returned result
+// is the first run with the category scores, audit scores and numeric values replaced by
+// their medians. Values missing in a run are aggregated over the remaining runs.
+func aggregateRuns(runs []*Result) (*Result, *RunStats) {
+	var (
+		total      []float64
+		categories = map[string][]float64{}
+		audits     = map[string][]float64{}
+		numeric    = map[string][]float64{}
+	)
+
+	for _, r := range runs {
+		lhr := r.Lighthouse
+		if lhr == nil {
+			continue
+		}
+
+		total = append(total, lhr.TotalDuration)
+
+		for name, score := range lhr.Categories {
+			categories[name] = append(categories[name], score)
+		}
+
+		for k, a := range lhr.Audits {
+			if a.Score != nil {
+				audits[k] = append(audits[k], *a.Score)
+			}
+			if a.NumericUnit != "" {
+				numeric[k] = append(numeric[k], a.NumericValue)
+			}
+		}
+	}
+
+	stats := &RunStats{
+		Count:      len(runs),
+		Categories: make(map[string]Stats, len(categories)),
+		Audits:     make(map[string]Stats, len(audits)),
+		Numeric:    make(map[string]Stats, len(numeric)),
+	}
+	for k, values := range categories {
+		stats.Categories[k] = newStats(values)
+	}
+	for k, values := range audits {
+		stats.Audits[k] = newStats(values)
+	}
+	for k, values := range numeric {
+		stats.Numeric[k] = newStats(values)
+	}
+
+	// copy the first run so the results of the runs stay untouched
+	result := *runs[0]
+	if runs[0].Lighthouse == nil {
+		return &result, stats
+	}
+
+	lhr := &LighthouseResult{
+		TotalDuration: newStats(total).Median,
+		Categories:    make(map[string]float64, len(stats.Categories)),
+		Audits:        make(map[string]Audit, len(runs[0].Lighthouse.Audits)),
+	}
+	for k, s := range stats.Categories {
+		lhr.Categories[k] = s.Median
+	}
+	for k, a := range runs[0].Lighthouse.Audits {
+		if s, ok := stats.Audits[k]; ok {
+			score := s.Median
+			a.Score = &score
+		}
+		if s, ok := stats.Numeric[k]; ok {
+			a.NumericValue = s.Median
+		}
+		lhr.Audits[k] = a
+	}
+	result.Lighthouse = lhr
+
+	return &result, stats
+}
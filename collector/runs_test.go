@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/pagespeedonline/v5"
+)
+
+func Test_newStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   Stats
+	}{
+		{"single", []float64{0.5}, Stats{Median: 0.5, Min: 0.5, Max: 0.5}},
+		{"odd", []float64{0.9, 0.5, 0.7}, Stats{Median: 0.7, Min: 0.5, Max: 0.9, StdDev: math.Sqrt(0.08 / 3)}},
+		{"even", []float64{4, 1, 3, 2}, Stats{Median: 2.5, Min: 1, Max: 4, StdDev: math.Sqrt(1.25)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newStats(tt.values)
+			if got.Median != tt.want.Median || got.Min != tt.want.Min || got.Max != tt.want.Max || math.Abs(got.StdDev-tt.want.StdDev) > 1e-9 {
+				t.Errorf("newStats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newRunResponse(performance float64, lcp float64) *pagespeedonline.PagespeedApiPagespeedResponseV5 {
+	return &pagespeedonline.PagespeedApiPagespeedResponseV5{
+		Id: "https://example.com/",
+		LighthouseResult: &pagespeedonline.LighthouseResultV5{
+			Timing: &pagespeedonline.Timing{Total: lcp * 10},
+			Categories: &pagespeedonline.Categories{
+				Performance: &pagespeedonline.LighthouseCategoryV5{Id: CategoryPerformance, Score: performance},
+			},
+			Audits: map[string]pagespeedonline.LighthouseAuditResultV5{
+				"largest-contentful-paint": {Score: performance, NumericValue: lcp, NumericUnit: "millisecond"},
+				"structured-data":          {Score: nil},
+			},
+		},
+	}
+}
+
+func Test_aggregateRuns(t *testing.T) {
+	runs := []*Result{
+		newResult(newRunResponse(0.9, 1000)),
+		newResult(newRunResponse(0.5, 3000)),
+		newResult(newRunResponse(0.7, 2000)),
+	}
+
+	result, stats := aggregateRuns(runs)
+
+	if stats.Count != 3 {
+		t.Errorf("stats.Count = %d, want 3", stats.Count)
+	}
+	if got := stats.Categories[CategoryPerformance]; got.Median != 0.7 || got.Min != 0.5 || got.Max != 0.9 {
+		t.Errorf("performance stats = %+v, want median 0.7, min 0.5, max 0.9", got)
+	}
+	if got := stats.Numeric["largest-contentful-paint"]; got.Median != 2000 || got.Min != 1000 || got.Max != 3000 {
+		t.Errorf("largest-contentful-paint stats = %+v, want median 2000, min 1000, max 3000", got)
+	}
+	if _, ok := stats.Audits["structured-data"]; ok {
+		t.Error("audits without a score should not be aggregated")
+	}
+
+	lhr := result.Lighthouse
+	if lhr.Categories[CategoryPerformance] != 0.7 {
+		t.Errorf("median performance score = %v, want 0.7", lhr.Categories[CategoryPerformance])
+	}
+	if got := lhr.Audits["largest-contentful-paint"]; got.NumericValue != 2000 || *got.Score != 0.7 || got.NumericUnit != "millisecond" {
+		t.Errorf("median largest-contentful-paint = %+v, want 2000 ms with score 0.7", got)
+	}
+	if lhr.TotalDuration != 20000 {
+		t.Errorf("median total duration = %v, want 20000", lhr.TotalDuration)
+	}
+
+	if runs[0].Lighthouse.Categories[CategoryPerformance] != 0.9 || runs[0].Lighthouse.Audits["largest-contentful-paint"].NumericValue != 1000 {
+		t.Error("aggregating should not modify the runs")
+	}
+}
+
+func Test_PagespeedScrapeServiceRuns(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		_ = json.NewEncoder(w).Encode(newRunResponse(float64(n)/10, float64(n)*1000))
+	}))
+	defer server.Close()
+
+	service, err := newPagespeedScrapeService(scrapeServiceConfig{
+		concurrency: 1,
+		options:     []option.ClientOption{option.WithAPIKey("KEY"), option.WithEndpoint(server.URL)},
+	})
+	if err != nil {
+		t.Fatalf("newPagespeedScrapeService should not throw an error: %v", err)
+	}
+
+	request := ScrapeRequest{Url: "https://example.com/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}, Runs: 3}
+	scrapes, err := service.Scrape(context.Background(), []ScrapeRequest{request})
+	if err != nil {
+		t.Fatalf("scrape should not throw an error: %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("API was called %d times, want 3", calls)
+	}
+	scrape := scrapes[0]
+	if scrape.Error != nil {
+		t.Fatalf("scrape should not fail: %v", scrape.Error)
+	}
+	if scrape.Stats == nil || scrape.Stats.Count != 3 {
+		t.Fatalf("scrape stats = %+v, want 3 runs", scrape.Stats)
+	}
+	if got := scrape.Result.Lighthouse.Categories[CategoryPerformance]; got != 0.2 {
+		t.Errorf("median performance score = %v, want 0.2", got)
+	}
+}
@@ -0,0 +1,193 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scheduler refreshes scrape requests in the background and keeps the latest
+// result of every target, so collecting metrics does not block on the API.
+// Targets are refreshed on their own interval or cron schedule if they define one
+// and at the default interval otherwise. Every target is refreshed on its own, so a slow
+// target does not hold back the others.
+type scheduler struct {
+	scrapeService scrapeService
+	interval      time.Duration
+	entries       []*scheduleEntry
+	mutex         sync.RWMutex
+	slots         chan struct{} // bounds the targets refreshed at the same time
+	running       sync.WaitGroup
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+type scheduleEntry struct {
+	request    ScrapeRequest
+	schedule   *cronSchedule
+	next       time.Time
+	refreshing bool
+	result     *ScrapeResult // the last successful result flagged with the error of a failed refresh since
+}
+
+// newScheduler creates a scheduler of the requests refreshing up to concurrency targets at the same time,
+// its scrapes are canceled with the context
+func newScheduler(ctx context.Context, svc scrapeService, interval time.Duration, concurrency int, requests []ScrapeRequest) *scheduler {
+	now := time.Now()
+	entries := make([]*scheduleEntry, 0, len(requests))
+	for _, r := range requests {
+		e := &scheduleEntry{request: r}
+		if r.Schedule != "" {
+			schedule, err := parseCronSchedule(r.Schedule)
+			if err != nil {
+				log.WithError(err).WithField("target", r.Url).Warn("ignoring target with invalid schedule")
+				continue
+			}
+			e.schedule = schedule
+			// targets on a schedule wait for their first slot, all others are scraped right away
+			if e.next = schedule.next(now); e.next.IsZero() {
+				log.WithField("target", r.Url).Warn("ignoring target with a schedule that never runs")
+				continue
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &scheduler{
+		scrapeService: svc,
+		interval:      interval,
+		entries:       entries,
+		slots:         make(chan struct{}, max(concurrency, 1)),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// start refreshes all targets right away and then whenever they are due
+func (s *scheduler) start() {
+	go s.run()
+}
+
+// stop ends the background refresh and waits for the canceled scrapes to return
+func (s *scheduler) stop() {
+	s.cancel()
+	s.running.Wait()
+}
+
+func (s *scheduler) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		s.refresh(time.Now())
+		timer.Reset(time.Until(s.nextRun()))
+	}
+}
+
+// refresh starts the refresh of all entries due at the given time which are not refreshed yet
+func (s *scheduler) refresh(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, e := range s.entries {
+		if e.refreshing || e.next.After(now) {
+			continue
+		}
+		e.refreshing = true
+		e.next = s.following(e, now)
+
+		s.running.Add(1)
+		go s.refreshEntry(e)
+	}
+}
+
+// refreshEntry scrapes the entry once a slot is free and stores its result. A failed scrape
+// keeps the last successful result, flagged with the error.
+func (s *scheduler) refreshEntry(e *scheduleEntry) {
+	defer s.running.Done()
+
+	var result *ScrapeResult
+	select {
+	case s.slots <- struct{}{}:
+		results, err := s.scrapeService.Scrape(s.ctx, []ScrapeRequest{e.request})
+		<-s.slots
+		if err != nil {
+			log.WithError(err).WithField("target", e.request.Url).Warn("could not refresh scheduled target")
+		}
+		if len(results) > 0 {
+			result = results[0]
+		}
+	case <-s.ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e.refreshing = false
+
+	switch {
+	case result == nil || s.ctx.Err() != nil:
+		// stopped, the result is not collected anymore
+	case result.Error == nil || e.result == nil || e.result.Result == nil:
+		e.result = result
+	default:
+		failed := *e.result
+		failed.Error = result.Error
+		failed.Duration = result.Duration
+		e.result = &failed
+	}
+}
+
+// following returns the next refresh of the entry after the given time
+func (s *scheduler) following(e *scheduleEntry, now time.Time) time.Time {
+	switch {
+	case e.schedule != nil:
+		if next := e.schedule.next(now); !next.IsZero() {
+			return next
+		}
+		return now.AddDate(5, 0, 0)
+	case e.request.Interval > 0:
+		return now.Add(time.Duration(e.request.Interval))
+	default:
+		return now.Add(s.interval)
+	}
+}
+
+func (s *scheduler) nextRun() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if len(s.entries) == 0 {
+		return time.Now().Add(time.Hour)
+	}
+
+	next := s.entries[0].next
+	for _, e := range s.entries[1:] {
+		if e.next.Before(next) {
+			next = e.next
+		}
+	}
+	return next
+}
+
+// snapshot returns the latest result of every target refreshed at least once
+func (s *scheduler) snapshot() []*ScrapeResult {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	results := make([]*ScrapeResult, 0, len(s.entries))
+	for _, e := range s.entries {
+		if e.result != nil {
+			results = append(results, e.result)
+		}
+	}
+	return results
+}
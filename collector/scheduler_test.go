@@ -0,0 +1,229 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// echoScrapeService returns an empty result for every request and records the scraped targets.
+// Scrapes of failing targets return the error, those of blocked targets wait until the channel is closed.
+type echoScrapeService struct {
+	mutex    sync.Mutex
+	scraped  []ScrapeRequest
+	failing  map[string]error
+	blocking map[string]chan struct{}
+}
+
+func (e *echoScrapeService) Scrape(ctx context.Context, requests []ScrapeRequest) ([]*ScrapeResult, error) {
+	var results []*ScrapeResult
+	for _, r := range requests {
+		e.mutex.Lock()
+		e.scraped = append(e.scraped, r)
+		err, block := e.failing[r.Url], e.blocking[r.Url]
+		e.mutex.Unlock()
+
+		if block != nil {
+			select {
+			case <-block:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			results = append(results, &ScrapeResult{Request: r, Error: err, Timestamp: time.Now()})
+			continue
+		}
+		results = append(results, &ScrapeResult{Request: r, Result: &Result{}, Timestamp: time.Now()})
+	}
+	return results, nil
+}
+
+// scrapes returns the number of scrapes so far
+func (e *echoScrapeService) scrapes() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.scraped)
+}
+
+func Test_schedulerRefresh(t *testing.T) {
+	svc := &echoScrapeService{}
+	requests := CalculateScrapeRequests([]string{"http://test.com"}, nil)
+	s := newScheduler(context.Background(), svc, time.Hour, 2, requests)
+
+	if got := len(s.snapshot()); got != 0 {
+		t.Fatalf("snapshot() before refresh returned %d results, want 0", got)
+	}
+
+	now := time.Now()
+	s.refresh(now)
+	s.running.Wait()
+	if got := len(s.snapshot()); got != len(requests) {
+		t.Fatalf("snapshot() returned %d results, want %d", got, len(requests))
+	}
+
+	s.refresh(now.Add(30 * time.Minute))
+	s.running.Wait()
+	if got := len(svc.scraped); got != len(requests) {
+		t.Errorf("targets not due were scraped again, got %d scrapes, want %d", got, len(requests))
+	}
+
+	if got := s.nextRun(); !got.Equal(now.Add(time.Hour)) {
+		t.Errorf("nextRun() = %v, want %v", got, now.Add(time.Hour))
+	}
+
+	s.refresh(now.Add(time.Hour))
+	s.running.Wait()
+	if got := len(svc.scraped); got != 2*len(requests) {
+		t.Errorf("due targets were not scraped again, got %d scrapes, want %d", got, 2*len(requests))
+	}
+}
+
+func Test_schedulerTargetTiming(t *testing.T) {
+	svc := &echoScrapeService{}
+	requests := []ScrapeRequest{
+		{Url: "http://test.com/", Strategy: StrategyMobile},
+		{Url: "http://test.com/home", Strategy: StrategyMobile, Interval: Duration(15 * time.Minute)},
+		{Url: "http://test.com/deep", Strategy: StrategyMobile, Schedule: "@daily"},
+	}
+	s := newScheduler(context.Background(), svc, time.Hour, 2, requests)
+
+	now := time.Now()
+	s.refresh(now)
+	s.running.Wait()
+	if got := len(svc.scraped); got != 2 {
+		t.Fatalf("first refresh scraped %d targets, want 2 as scheduled targets wait for their slot", got)
+	}
+
+	s.refresh(now.Add(15 * time.Minute))
+	s.running.Wait()
+	if got := svc.scraped[len(svc.scraped)-1].Url; len(svc.scraped) != 3 || got != "http://test.com/home" {
+		t.Errorf("refresh after 15m should only scrape the target with its own interval, scraped %v", svc.scraped)
+	}
+
+	schedule, _ := parseCronSchedule("@daily")
+	if got, want := s.entries[2].next, schedule.next(now); !got.Equal(want) {
+		t.Errorf("scheduled target next run = %v, want %v", got, want)
+	}
+}
+
+func Test_schedulerStart(t *testing.T) {
+	svc := &echoScrapeService{}
+	requests := CalculateScrapeRequests([]string{"http://test.com"}, nil)
+	s := newScheduler(context.Background(), svc, time.Hour, 2, requests)
+	s.start()
+	defer s.stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.snapshot()) != len(requests) {
+		if time.Now().After(deadline) {
+			t.Fatal("scheduler did not refresh targets after start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitRefreshed waits until the refresh of the entry at the index returned
+func waitRefreshed(t *testing.T, s *scheduler, index int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mutex.RLock()
+		refreshing := s.entries[index].refreshing
+		s.mutex.RUnlock()
+		if !refreshing {
+			return
+		}
+	}
+	t.Fatal("refresh of the entry did not return")
+}
+
+func Test_schedulerSlowTarget(t *testing.T) {
+	release := make(chan struct{})
+	svc := &echoScrapeService{blocking: map[string]chan struct{}{"http://test.com/deep": release}}
+	requests := []ScrapeRequest{
+		{Url: "http://test.com/deep", Strategy: StrategyMobile},
+		{Url: "http://test.com/home", Strategy: StrategyMobile, Interval: Duration(15 * time.Minute)},
+	}
+	s := newScheduler(context.Background(), svc, time.Hour, 2, requests)
+	defer s.stop()
+
+	// the fast target is refreshed on its own interval while the slow one is still running
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		s.refresh(now.Add(time.Duration(i) * 15 * time.Minute))
+		waitRefreshed(t, s, 1)
+	}
+	close(release)
+	s.running.Wait()
+
+	if got := svc.scrapes(); got != 4 {
+		t.Errorf("refreshes scraped %d targets, want the slow target once and the fast one 3 times", got)
+	}
+}
+
+func Test_schedulerFailedRefresh(t *testing.T) {
+	svc := &echoScrapeService{}
+	requests := []ScrapeRequest{{Url: "http://test.com/", Strategy: StrategyMobile}}
+	s := newScheduler(context.Background(), svc, time.Hour, 1, requests)
+
+	now := time.Now()
+	s.refresh(now)
+	s.running.Wait()
+	good := s.snapshot()[0]
+
+	svc.mutex.Lock()
+	svc.failing = map[string]error{"http://test.com/": errors.New("backend error")}
+	svc.mutex.Unlock()
+	s.refresh(now.Add(time.Hour))
+	s.running.Wait()
+
+	got := s.snapshot()[0]
+	if got.Error == nil || got.Result != good.Result || !got.Timestamp.Equal(good.Timestamp) {
+		t.Errorf("snapshot() = %+v, want the last successful result flagged with the error", got)
+	}
+
+	expected := `
+# HELP pagespeed_scrape_target_error Set to 1 with the error class if the last scrape of the target failed
+# TYPE pagespeed_scrape_target_error gauge
+pagespeed_scrape_target_error{class="unknown",host="http://test.com",path="/",strategy="mobile"} 1
+# HELP pagespeed_scrape_target_stale_seconds Time since the exported result of the target expired in the cache, 0 if it is fresh
+# TYPE pagespeed_scrape_target_stale_seconds gauge
+pagespeed_scrape_target_stale_seconds{host="http://test.com",path="/",strategy="mobile"} 0
+# HELP pagespeed_up Whether the last scrape of the target was successful (1) or not (0)
+# TYPE pagespeed_up gauge
+pagespeed_up{host="http://test.com",path="/",strategy="mobile"} 0
+`
+	coll := collector{scheduler: s, descs: newDescriptors()}
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected),
+		"pagespeed_scrape_target_error", "pagespeed_scrape_target_stale_seconds", "pagespeed_up"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_collectorScopedTargets(t *testing.T) {
+	requests := []ScrapeRequest{{Url: "https://example.com/", Strategy: StrategyMobile, Interval: Duration(time.Hour)}}
+	factory := NewFactory(WithEndpoint("http://psi.invalid/"))
+
+	scheduled, err := factory.Create(Config{GoogleAPIKey: "KEY", ScrapeRequests: requests})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+	defer scheduled.(collector).Close()
+	if scheduled.(collector).scheduler == nil {
+		t.Error("targets with their own interval should be refreshed in the background")
+	}
+
+	// collectors of probes must not refresh their targets once the request returned
+	scoped, err := factory.Create(Config{Context: context.Background(), GoogleAPIKey: "KEY", ScrapeRequests: requests})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+	if c := scoped.(collector); c.scheduler != nil || len(c.requests) != len(requests) {
+		t.Error("collectors bound to a request should scrape all targets on collect")
+	}
+}
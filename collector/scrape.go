@@ -3,7 +3,7 @@ package collector
 import (
 	"context"
 	"net/http"
-	"runtime"
+	"slices"
 	"sync"
 	"time"
 
@@ -18,13 +18,71 @@ import (
 var _ scrapeService = &pagespeedScrapeService{}
 
 type scrapeService interface {
-	Scrape(parallel bool, config []ScrapeRequest) (scrapes []*ScrapeResult, err error)
+	// Scrape returns a result for every request. Requests which could not be scraped before
+	// the context is done are reported with the context error.
+	Scrape(ctx context.Context, config []ScrapeRequest) (scrapes []*ScrapeResult, err error)
+}
+
+// scrapeServiceConfig configures a pagespeedScrapeService
+type scrapeServiceConfig struct {
+	clientTimeout   time.Duration     // 0 disables the client timeout
+	cache           *ScrapeCache      // nil disables the cache
+	concurrency     int               // number of concurrent scrapes, at least 1
+	hostConcurrency int               // concurrent scrapes per host, 0 does not limit them
+	hosts           *hostLimiter      // nil limits the scrapes per host of this service only by hostConcurrency
+	limiter         *RateLimiter      // nil does not limit requests
+	group           *RequestGroup     // nil does not coalesce identical requests
+	retry           *RetryPolicy      // nil does not retry failed requests
+	backend         backend           // nil runs lighthouse with the PageSpeed Insights API
+	transport       http.RoundTripper // nil uses http.DefaultTransport
+	options         []option.ClientOption
+}
+
+// backend runs lighthouse once for a request
+type backend interface {
+	run(ctx context.Context, request ScrapeRequest) (*Result, error)
 }
 
 // newPagespeedScrapeService creates a new HTTP client service for pagespeed.
-// If the client timeout is set to 0 there will be no timeout
-func newPagespeedScrapeService(clientTimeout time.Duration, cacheTTL time.Duration, options ...option.ClientOption) (scrapeService, error) {
-	transport, err := googlehttp.NewTransport(context.Background(), http.DefaultTransport, options...)
+func newPagespeedScrapeService(config scrapeServiceConfig) (scrapeService, error) {
+	b := config.backend
+	if b == nil {
+		var err error
+		b, err = newPSIBackend(config.clientTimeout, config.transport, config.limiter, nil, config.options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	concurrency := config.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	hosts := config.hosts
+	if hosts == nil {
+		hosts = newHostLimiter(config.hostConcurrency)
+	}
+
+	return &pagespeedScrapeService{
+		backend:      b,
+		cache:        config.cache,
+		group:        config.group,
+		retry:        config.retry,
+		concurrency:  concurrency,
+		hosts:        hosts,
+		timeout:      config.clientTimeout,
+		revalidating: &sync.Map{},
+	}, nil
+}
+
+// newGoogleClient creates an HTTP client authenticating requests to google APIs with the options
+func newGoogleClient(timeout time.Duration, base http.RoundTripper, options []option.ClientOption) (*http.Client, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	transport, err := googlehttp.NewTransport(context.Background(), base, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -33,40 +91,34 @@ func newPagespeedScrapeService(clientTimeout time.Duration, cacheTTL time.Durati
 		Transport: transport,
 	}
 
-	if clientTimeout != 0 {
-		client.Timeout = clientTimeout
+	if timeout != 0 {
+		client.Timeout = timeout
 	}
-
-	return &pagespeedScrapeService{
-		scrapeClient: client,
-		options:      options,
-		cache:        newScrapeCache(cacheTTL),
-	}, nil
+	return client, nil
 }
 
 type pagespeedScrapeService struct {
-	scrapeClient *http.Client
-	options      []option.ClientOption
-	cache        *scrapeCache
+	backend      backend
+	cache        *ScrapeCache
+	group        *RequestGroup
+	retry        *RetryPolicy
+	concurrency  int
+	hosts        *hostLimiter  // shared by all scrapes of the service, so the limit holds across collects and the scheduler
+	timeout      time.Duration // bounds background refreshes, 0 does not limit them
+	revalidating *sync.Map     // cache keys refreshed in the background, so concurrent stale hits start a single refresh
 }
 
-func (pss *pagespeedScrapeService) Scrape(parallel bool, requests []ScrapeRequest) (scrapes []*ScrapeResult, err error) {
+func (pss *pagespeedScrapeService) Scrape(ctx context.Context, requests []ScrapeRequest) (scrapes []*ScrapeResult, err error) {
 
-	maxWorkers := 1
-	if parallel {
-		maxWorkers = runtime.NumCPU()
+	maxWorkers := pss.concurrency
+	if maxWorkers > len(requests) {
+		maxWorkers = len(requests)
 	}
 
-	results := make(chan *ScrapeResult, 2*len(requests))
+	results := make(chan *ScrapeResult, len(requests))
 
-	// Fill queue with scrape requests
-	requestChan := make(chan ScrapeRequest)
-	go func() {
-		for _, r := range requests {
-			requestChan <- r
-		}
-		close(requestChan)
-	}()
+	// Queue scrape requests by priority and host
+	queue := newScrapeQueue(ctx, requests, pss.hosts)
 
 	wg := sync.WaitGroup{}
 	wg.Add(maxWorkers)
@@ -74,17 +126,13 @@ func (pss *pagespeedScrapeService) Scrape(parallel bool, requests []ScrapeReques
 	for i := 0; i < maxWorkers; i++ {
 		go func() {
 			defer wg.Done()
-			for request := range requestChan {
-				scrape, err := pss.scrape(request)
-				if err != nil {
-					log.WithError(err).
-						WithFields(log.Fields{
-							"target":   request.Url,
-							"strategy": request.Strategy,
-						}).Warn("target scraping returned an error")
-					continue
+			for {
+				request, ok := queue.next()
+				if !ok {
+					return
 				}
-				results <- scrape
+				results <- pss.scrapeTarget(ctx, request)
+				queue.done(request)
 			}
 		}()
 	}
@@ -100,19 +148,272 @@ func (pss *pagespeedScrapeService) Scrape(parallel bool, requests []ScrapeReques
 	return
 }
 
-func (pss pagespeedScrapeService) scrape(request ScrapeRequest) (scrape *ScrapeResult, err error) {
+// scrapeTarget scrapes a single request and reports failures in the result
+func (pss *pagespeedScrapeService) scrapeTarget(ctx context.Context, request ScrapeRequest) *ScrapeResult {
+	result := ScrapeResult{Request: request}
+	if ctx.Err() != nil {
+		result.Error = ctx.Err()
+		result.Timestamp = time.Now()
+		return &result
+	}
+
+	start := time.Now()
+	scrape, err := pss.scrape(ctx, request)
+	if err != nil {
+		log.WithError(err).
+			WithFields(log.Fields{
+				"target":   request.Url,
+				"strategy": request.Strategy,
+				"class":    classifyError(err),
+			}).Warn("target scraping returned an error")
+		if scrape != nil {
+			// keep the last result of a target whose refresh failed, flagged with the error
+			result = *scrape
+			result.Request = request
+		} else {
+			result.Timestamp = time.Now()
+		}
+		result.Error = err
+	} else {
+		// copy as the scrape might be shared with the cache, whose request may differ in irrelevant fields
+		result = *scrape
+		result.Request = request
+	}
+	result.Duration = time.Since(start)
+	return &result
+}
+
+func (pss pagespeedScrapeService) scrape(ctx context.Context, request ScrapeRequest) (scrape *ScrapeResult, err error) {
 	cacheKey := cacheKeyFromRequest(request)
-	if pss.cache != nil {
-		if cached, ok := pss.cache.get(cacheKey); ok {
-			return cached, nil
+
+	// a result of all categories satisfies requests of fewer categories
+	keys := []string{cacheKey}
+	superset := request
+	superset.Categories = sortedCategories()
+	supersetKey := cacheKeyFromRequest(superset)
+	if supersetKey != cacheKey {
+		keys = append(keys, supersetKey)
+	}
+
+	cached, stale, ok := pss.cache.get(keys...)
+	narrowed := cached != nil && !slices.Equal(normalizeCategories(cached.Request.Categories), normalizeCategories(request.Categories))
+	if narrowed {
+		cached = narrowResult(cached, request.Categories)
+	}
+	if ok {
+		if stale {
+			// serve the expired result right away and refresh the entry hit, it is kept until a refresh succeeds
+			hit, hitKey := request, cacheKey
+			if narrowed {
+				hit, hitKey = superset, supersetKey
+			}
+			if _, running := pss.revalidating.LoadOrStore(hitKey, struct{}{}); !running {
+				go pss.revalidate(hit, hitKey)
+			}
+		}
+		return cached, nil
+	}
+
+	scrape, err = pss.refresh(ctx, request, cacheKey)
+	if err != nil && cached != nil {
+		// the result expired beyond the grace period is still reported along with the error
+		return cached, err
+	}
+	return scrape, err
+}
+
+// narrowResult returns a copy of a result of more categories limited to the categories
+func narrowResult(scrape *ScrapeResult, categories []string) *ScrapeResult {
+	narrowed := *scrape
+	if scrape.Result == nil || scrape.Result.Lighthouse == nil {
+		return &narrowed
+	}
+
+	result := *scrape.Result
+	result.Lighthouse = scrape.Result.Lighthouse.forCategories(categories)
+	narrowed.Result = &result
+
+	if scrape.Stats != nil {
+		stats := &RunStats{
+			Count:      scrape.Stats.Count,
+			Categories: make(map[string]Stats, len(categories)),
+			Audits:     make(map[string]Stats, len(result.Lighthouse.Audits)),
+			Numeric:    make(map[string]Stats, len(result.Lighthouse.Audits)),
+		}
+		for _, c := range categories {
+			if s, ok := scrape.Stats.Categories[c]; ok {
+				stats.Categories[c] = s
+			}
+		}
+		for k := range result.Lighthouse.Audits {
+			if s, ok := scrape.Stats.Audits[k]; ok {
+				stats.Audits[k] = s
+			}
+			if s, ok := scrape.Stats.Numeric[k]; ok {
+				stats.Numeric[k] = s
+			}
+		}
+		narrowed.Stats = stats
+	}
+	return &narrowed
+}
+
+// refresh fetches the request and caches the result. The cache is only filled after
+// the API returned, so calls in flight are shared until then. The flight caches the
+// result once, not every caller waiting for it.
+func (pss pagespeedScrapeService) refresh(ctx context.Context, request ScrapeRequest, cacheKey string) (*ScrapeResult, error) {
+	return pss.group.do(ctx, cacheKey, func(ctx context.Context) (*ScrapeResult, error) {
+		scrape, err := pss.fetch(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		pss.cache.set(cacheKey, scrape)
+		return scrape, nil
+	})
+}
+
+// revalidate refreshes an expired result in the background
+func (pss pagespeedScrapeService) revalidate(request ScrapeRequest, cacheKey string) {
+	defer pss.revalidating.Delete(cacheKey)
+
+	ctx := context.Background()
+	if pss.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pss.timeout)
+		defer cancel()
+	}
+
+	if _, err := pss.refresh(ctx, request, cacheKey); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"target":   request.Url,
+			"strategy": request.Strategy,
+			"class":    classifyError(err),
+		}).Warn("could not refresh expired target, serving the stale result")
+	}
+}
+
+// fetch runs the request with the backend
+func (pss pagespeedScrapeService) fetch(ctx context.Context, request ScrapeRequest) (scrape *ScrapeResult, err error) {
+	// runs are sequential so they don't compete with each other for the resources of the target
+	var (
+		runs   []*Result
+		errRun error
+	)
+	for i := 0; i < request.runs(); i++ {
+		result, err := pss.run(ctx, request)
+		if err != nil {
+			errRun = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		runs = append(runs, result)
+	}
+	if len(runs) == 0 {
+		return nil, errRun
+	}
+
+	scrapeResult := &ScrapeResult{
+		Request:   request,
+		Result:    runs[0],
+		Timestamp: time.Now(),
+	}
+	if request.runs() > 1 {
+		if errRun != nil {
+			log.WithError(errRun).WithFields(log.Fields{
+				"target":   request.Url,
+				"strategy": request.Strategy,
+				"runs":     len(runs),
+			}).Warn("aggregating the successful runs of the target")
 		}
+		scrapeResult.Result, scrapeResult.Stats = aggregateRuns(runs)
+	}
+	return scrapeResult, nil
+}
+
+// run runs lighthouse once, retrying failed runs with the retry policy
+func (pss pagespeedScrapeService) run(ctx context.Context, request ScrapeRequest) (result *Result, err error) {
+	err = pss.retry.do(ctx, request, func() (err error) {
+		result, err = pss.backend.run(ctx, request)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return result, nil
+}
+
+// psiBackend runs lighthouse with the PageSpeed Insights API
+type psiBackend struct {
+	scrapeClient *http.Client
+	options      []option.ClientOption
+	limiter      *RateLimiter   // nil does not limit requests
+	keys         *KeyPool       // nil authenticates all requests with the options
+	keyClients   []*http.Client // authenticating with the key of the same index in the pool
+}
+
+// newPSIBackend creates a backend for the API. With a key pool the requests are authenticated by the
+// keys of the pool, so the options must not contain an API key or credentials.
+func newPSIBackend(timeout time.Duration, transport http.RoundTripper, limiter *RateLimiter, keys *KeyPool, options []option.ClientOption) (*psiBackend, error) {
+	b := &psiBackend{options: options, limiter: limiter, keys: keys}
+	if keys == nil {
+		client, err := newGoogleClient(timeout, transport, options)
+		if err != nil {
+			return nil, err
+		}
+		b.scrapeClient = client
+		return b, nil
+	}
+
+	for _, k := range keys.keys {
+		client, err := newGoogleClient(timeout, transport, append([]option.ClientOption{k.option}, options...))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not create client for API key %s", k.id)
+		}
+		b.keyClients = append(b.keyClients, client)
+	}
+	return b, nil
+}
+
+func (b *psiBackend) run(ctx context.Context, request ScrapeRequest) (*Result, error) {
+	if err := b.limiter.Wait(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not wait for rate limiter")
+	}
+
+	client := b.scrapeClient
+	var key *poolKey
+	if b.keys != nil {
+		var err error
+		if key, err = b.keys.acquire(); err != nil {
+			return nil, err
+		}
+		client = b.keyClients[key.index]
+	}
+
+	result, err := b.call(ctx, client, request)
+	if key != nil {
+		b.keys.report(key, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runtimeError(result.LighthouseResult); err != nil {
+		return nil, err
+	}
+	return newResult(result), nil
+}
+
+// call requests the API with the client
+func (b *psiBackend) call(ctx context.Context, client *http.Client, request ScrapeRequest) (*pagespeedonline.PagespeedApiPagespeedResponseV5, error) {
 	opts := []option.ClientOption{
-		option.WithHTTPClient(pss.scrapeClient),
+		option.WithHTTPClient(client),
 	}
-	opts = append(opts, pss.options...)
+	opts = append(opts, b.options...)
 	service, err := pagespeedonline.NewService(
-		context.Background(),
+		ctx,
 		opts...,
 	)
 	if err != nil {
@@ -134,19 +435,15 @@ func (pss pagespeedScrapeService) scrape(request ScrapeRequest) (scrape *ScrapeR
 		call.UtmSource(request.Source)
 	}
 
-	call.Context(context.WithValue(context.Background(), oauth2.HTTPClient, pss.scrapeClient))
+	call.Context(context.WithValue(ctx, oauth2.HTTPClient, client))
 
-	result, errResult := call.Do()
-	if errResult != nil {
-		return nil, errResult
-	}
+	return call.Do()
+}
 
-	scrapeResult := &ScrapeResult{
-		Request: request,
-		Result:  result,
-	}
-	if pss.cache != nil {
-		pss.cache.set(cacheKey, scrapeResult)
+// runtimeError returns the runtime error of a lighthouse result which could not audit the target
+func runtimeError(lhr *pagespeedonline.LighthouseResultV5) error {
+	if lhr != nil && lhr.RuntimeError != nil && lhr.RuntimeError.Code != "" && lhr.RuntimeError.Code != "NO_ERROR" {
+		return &LighthouseError{Code: lhr.RuntimeError.Code, Message: lhr.RuntimeError.Message}
 	}
-	return scrapeResult, nil
+	return nil
 }
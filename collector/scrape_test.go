@@ -1,7 +1,14 @@
 package collector
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,12 +39,12 @@ func Test_PagespeedScrapeService(t *testing.T) {
 		t.Skip("skipping testing unless API key or credentials file is set")
 	}
 
-	service, err := newPagespeedScrapeService(30*time.Second, 0, options...) // cache disabled for test
+	service, err := newPagespeedScrapeService(scrapeServiceConfig{clientTimeout: 30 * time.Second, concurrency: 2, options: options}) // cache disabled for test
 	if err != nil {
 		t.Fatalf("newPagespeedScrapeService should not throw an error: %v", err)
 	}
 
-	scrapes, err := service.Scrape(true, CalculateScrapeRequests([]string{"http://example.com/"}, nil))
+	scrapes, err := service.Scrape(context.Background(), CalculateScrapeRequests([]string{"http://example.com/"}, nil))
 	if err != nil {
 		t.Fatal("scrape should not throw an error")
 	}
@@ -45,3 +52,234 @@ func Test_PagespeedScrapeService(t *testing.T) {
 		t.Fatal("scrape should return 2 results for strategies")
 	}
 }
+
+func Test_PagespeedScrapeServiceCanceled(t *testing.T) {
+	service, err := newPagespeedScrapeService(scrapeServiceConfig{concurrency: 2, options: []option.ClientOption{option.WithAPIKey("KEY")}})
+	if err != nil {
+		t.Fatalf("newPagespeedScrapeService should not throw an error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	requests := CalculateScrapeRequests([]string{"http://example.com/"}, nil)
+	scrapes, err := service.Scrape(ctx, requests)
+	if err != nil {
+		t.Fatalf("scrape should not throw an error: %v", err)
+	}
+	if len(scrapes) != len(requests) {
+		t.Fatalf("scrape returned %d results, want one for each of the %d requests", len(scrapes), len(requests))
+	}
+	for _, s := range scrapes {
+		if classifyError(s.Error) != ErrorClassCanceled {
+			t.Errorf("scrape of %s %s error = %v, want canceled", s.Request.Url, s.Request.Strategy, s.Error)
+		}
+	}
+}
+
+func Test_PagespeedScrapeServiceStale(t *testing.T) {
+	var (
+		calls   int32
+		failing int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, `{"error":{"code":500,"message":"backend error"}}`, http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(newRunResponse(0.9, 1000))
+	}))
+	defer server.Close()
+
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour, Grace: time.Hour})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+	svc, err := newPagespeedScrapeService(scrapeServiceConfig{
+		cache:       cache,
+		concurrency: 1,
+		options:     []option.ClientOption{option.WithAPIKey("KEY"), option.WithEndpoint(server.URL)},
+	})
+	if err != nil {
+		t.Fatalf("newPagespeedScrapeService should not throw an error: %v", err)
+	}
+	request := ScrapeRequest{Url: "https://example.com/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}}
+	if scrapes, _ := svc.Scrape(context.Background(), []ScrapeRequest{request}); scrapes[0].Error != nil {
+		t.Fatalf("scrape should not fail: %v", scrapes[0].Error)
+	}
+
+	// expire the result while the API fails, the stale result keeps being served
+	atomic.StoreInt32(&failing, 1)
+	expire(cache, cacheKeyFromRequest(request), time.Now().Add(-time.Minute))
+
+	for i := 0; i < 2; i++ {
+		scrapes, _ := svc.Scrape(context.Background(), []ScrapeRequest{request})
+		if scrapes[0].Error != nil || scrapes[0].ExpiredAt.IsZero() {
+			t.Fatalf("scrape = %+v, want the stale result", scrapes[0])
+		}
+	}
+
+	// once the grace period ends, the last result is reported along with the error of the refresh
+	expire(cache, cacheKeyFromRequest(request), time.Now().Add(-2*time.Hour))
+	for i := 0; i < 2; i++ {
+		scrapes, _ := svc.Scrape(context.Background(), []ScrapeRequest{request})
+		if scrapes[0].Error == nil || scrapes[0].Result == nil || scrapes[0].ExpiredAt.IsZero() {
+			t.Fatalf("scrape = %+v, want the expired result along with the error", scrapes[0])
+		}
+	}
+
+	// the background refresh replaces the stale result once the API recovers
+	atomic.StoreInt32(&failing, 0)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		scrapes, _ := svc.Scrape(context.Background(), []ScrapeRequest{request})
+		if scrapes[0].ExpiredAt.IsZero() {
+			return
+		}
+	}
+	t.Error("stale result should be refreshed in the background")
+}
+
+func Test_PagespeedScrapeServiceStaleRevalidatedOnce(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour, Grace: time.Hour})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+	svc, err := newPagespeedScrapeService(scrapeServiceConfig{
+		clientTimeout: 5 * time.Second,
+		cache:         cache,
+		concurrency:   1,
+		backend: backendFunc(func(ctx context.Context, request ScrapeRequest) (*Result, error) {
+			atomic.AddInt32(&calls, 1)
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			return &Result{}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("newPagespeedScrapeService should not throw an error: %v", err)
+	}
+
+	request := ScrapeRequest{Url: "https://example.com/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}}
+	cache.set(cacheKeyFromRequest(request), &ScrapeResult{Request: request, Result: &Result{}})
+	expire(cache, cacheKeyFromRequest(request), time.Now().Add(-time.Minute))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scrapes, _ := svc.Scrape(context.Background(), []ScrapeRequest{request})
+			if scrapes[0].ExpiredAt.IsZero() {
+				t.Error("scrape should serve the stale result")
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, stale, _ := cache.get(cacheKeyFromRequest(request)); !stale {
+			break
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("backend was called %d times, want a single refresh for concurrent stale hits", n)
+	}
+}
+
+func Test_PagespeedScrapeServiceStaleSuperset(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		_ = json.NewEncoder(w).Encode(newRunResponse(0.9, 1000))
+	}))
+	defer server.Close()
+
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour, Grace: time.Hour})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+	svc, err := newPagespeedScrapeService(scrapeServiceConfig{
+		cache:       cache,
+		concurrency: 1,
+		options:     []option.ClientOption{option.WithAPIKey("KEY"), option.WithEndpoint(server.URL)},
+	})
+	if err != nil {
+		t.Fatalf("newPagespeedScrapeService should not throw an error: %v", err)
+	}
+
+	all := ScrapeRequest{Url: "https://example.com/", Strategy: StrategyMobile, Categories: sortedCategories()}
+	performance := ScrapeRequest{Url: "https://example.com/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}}
+	if _, err := svc.Scrape(context.Background(), []ScrapeRequest{all}); err != nil {
+		t.Fatalf("scrape should not throw an error: %v", err)
+	}
+	expire(cache, cacheKeyFromRequest(all), time.Now().Add(-time.Minute))
+
+	scrapes, err := svc.Scrape(context.Background(), []ScrapeRequest{performance})
+	if err != nil || scrapes[0].ExpiredAt.IsZero() {
+		t.Fatalf("scrape = %+v, %v, want the stale superset result", scrapes[0], err)
+	}
+
+	// the superset entry which was hit is refreshed, not the narrow one
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, stale, _ := cache.get(cacheKeyFromRequest(all)); !stale {
+			break
+		}
+	}
+	scrapes, err = svc.Scrape(context.Background(), []ScrapeRequest{all})
+	if err != nil || !scrapes[0].ExpiredAt.IsZero() {
+		t.Errorf("scrape = %+v, %v, want the refreshed superset result", scrapes[0], err)
+	}
+	if _, _, ok := cache.get(cacheKeyFromRequest(performance)); ok {
+		t.Error("the narrow request should not be cached on its own")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("API was called %d times, want a single refresh of the superset", n)
+	}
+}
+
+func Test_PagespeedScrapeServiceCategorySuperset(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		_ = json.NewEncoder(w).Encode(newRunResponse(0.9, 1000))
+	}))
+	defer server.Close()
+
+	cache, err := NewScrapeCache(CacheConfig{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewScrapeCache should not throw an error: %v", err)
+	}
+	svc, err := newPagespeedScrapeService(scrapeServiceConfig{
+		cache:       cache,
+		concurrency: 1,
+		options:     []option.ClientOption{option.WithAPIKey("KEY"), option.WithEndpoint(server.URL)},
+	})
+	if err != nil {
+		t.Fatalf("newPagespeedScrapeService should not throw an error: %v", err)
+	}
+
+	all := ScrapeRequest{Url: "https://example.com/", Strategy: StrategyMobile, Categories: []string{CategorySEO, CategoryPerformance, CategoryBestPractices, CategoryAccessibility}}
+	performance := ScrapeRequest{Url: "https://example.com", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}}
+
+	if _, err := svc.Scrape(context.Background(), []ScrapeRequest{all}); err != nil {
+		t.Fatalf("scrape should not throw an error: %v", err)
+	}
+	scrapes, err := svc.Scrape(context.Background(), []ScrapeRequest{performance})
+	if err != nil {
+		t.Fatalf("scrape should not throw an error: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("API was called %d times, want the performance request to reuse the cached result", calls)
+	}
+	if !reflect.DeepEqual(scrapes[0].Request, performance) {
+		t.Errorf("scrape request = %+v, want %+v", scrapes[0].Request, performance)
+	}
+}
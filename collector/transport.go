@@ -0,0 +1,59 @@
+package collector
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TransportConfig configures the connections to the google APIs
+type TransportConfig struct {
+	ProxyURL string // proxy of all API requests, empty uses the proxy environment variables
+	CAFile   string // PEM encoded certificates trusted in addition to the system roots, e.g. of a TLS intercepting proxy
+}
+
+// NewTransport creates the base transport of the API clients, nil if the default transport can be used
+func NewTransport(config TransportConfig) (http.RoundTripper, error) {
+	if config.ProxyURL == "" && config.CAFile == "" {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.ProxyURL != "" {
+		proxy, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proxy url")
+		}
+		if proxy.Scheme == "" || proxy.Host == "" {
+			return nil, errors.Errorf("invalid proxy url %q, it requires a scheme and host", config.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read CA file")
+		}
+
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in CA file %s", config.CAFile)
+		}
+
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,115 @@
+package collector
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewTransport(t *testing.T) {
+	dir := t.TempDir()
+	invalidCA := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidCA, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  TransportConfig
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "default", config: TransportConfig{}, wantNil: true},
+		{name: "proxy", config: TransportConfig{ProxyURL: "http://proxy:3128"}},
+		{name: "proxy without scheme", config: TransportConfig{ProxyURL: "proxy:3128"}, wantErr: true},
+		{name: "missing CA file", config: TransportConfig{CAFile: filepath.Join(dir, "missing.pem")}, wantErr: true},
+		{name: "CA file without certificates", config: TransportConfig{CAFile: invalidCA}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewTransport(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTransport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got == nil) != tt.wantNil {
+				t.Errorf("NewTransport() = %v, want nil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestNewTransportCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&http.Client{Transport: http.DefaultTransport}).Get(server.URL); err == nil {
+		t.Fatal("the default transport should not trust the test server")
+	}
+
+	transport, err := NewTransport(TransportConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewTransport should not throw an error: %v", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("the transport should trust the certificates of the CA file: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestNewTransportProxy(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		proxied  []string
+		response = newRunResponse(0.9, 1000)
+	)
+	// the proxy answers in place of the endpoint, which does not exist
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.Host+r.URL.Path)
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer proxy.Close()
+
+	transport, err := NewTransport(TransportConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("NewTransport should not throw an error: %v", err)
+	}
+
+	coll, err := NewFactory(WithTransport(transport), WithEndpoint("http://psi.invalid/")).Create(Config{
+		GoogleAPIKey:   "KEY",
+		ScrapeRequests: []ScrapeRequest{{Url: "https://example.com/", Strategy: StrategyMobile, Categories: []string{CategoryPerformance}}},
+	})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+
+	expected := `
+# HELP pagespeed_up Whether the last scrape of the target was successful (1) or not (0)
+# TYPE pagespeed_up gauge
+pagespeed_up{host="https://example.com",path="/",strategy="mobile"} 1
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected), "pagespeed_up"); err != nil {
+		t.Error(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) != 1 || proxied[0] != "psi.invalid/pagespeedonline/v5/runPagespeed" {
+		t.Errorf("proxied requests = %v, want the request to the endpoint", proxied)
+	}
+}
@@ -0,0 +1,48 @@
+package collector
+
+// unit describes how a raw API value is scaled and which suffix is appended to its metric name
+type unit struct {
+	suffix string
+	scale  float64
+}
+
+var (
+	unitMilliseconds = unit{suffix: "duration_seconds", scale: 1.0 / 1000}
+	unitCrUXScore    = unit{scale: 1.0 / 100} // CrUX reports layout shift scores multiplied by 100
+	unitRaw          = unit{scale: 1}
+)
+
+// lighthouseUnits maps the numericUnit of Lighthouse audits to their exported unit
+var lighthouseUnits = map[string]unit{
+	"millisecond": unitMilliseconds,
+	"byte":        {suffix: "bytes", scale: 1},
+	"element":     {suffix: "elements", scale: 1},
+	"unitless":    {suffix: "value", scale: 1},
+}
+
+// cruxMetric maps a CrUX metric key to its exported name and unit
+type cruxMetric struct {
+	name string
+	unit unit
+}
+
+// cruxMetrics are the known CrUX metric keys. Keys not listed here are exported
+// unscaled through the generic metric families, labeled with the lower case key.
+var cruxMetrics = map[string]cruxMetric{
+	"CUMULATIVE_LAYOUT_SHIFT_SCORE":          {"cumulative_layout_shift_score", unitCrUXScore},
+	"EXPERIMENTAL_INTERACTION_TO_NEXT_PAINT": {"experimental_interaction_to_next_paint", unitMilliseconds},
+	"EXPERIMENTAL_TIME_TO_FIRST_BYTE":        {"experimental_time_to_first_byte", unitMilliseconds},
+	"FIRST_CONTENTFUL_PAINT_MS":              {"first_contentful_paint", unitMilliseconds},
+	"FIRST_INPUT_DELAY_MS":                   {"first_input_delay", unitMilliseconds},
+	"INTERACTION_TO_NEXT_PAINT":              {"interaction_to_next_paint", unitMilliseconds},
+	"LARGEST_CONTENTFUL_PAINT_MS":            {"largest_contentful_paint", unitMilliseconds},
+}
+
+// names returns the metric names of the percentile, category ratio and threshold series
+func (m cruxMetric) names(prefix string) (value, ratio, threshold string) {
+	base := fqname(prefix, "metrics", m.name)
+	if m.unit.suffix == "" {
+		return base, base + "_category_ratio", base + "_threshold"
+	}
+	return base + "_" + m.unit.suffix, base + "_category_ratio", base + "_threshold_" + m.unit.suffix
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
@@ -25,17 +26,21 @@ type httpProbeHandler struct {
 	credentialsFile  string
 	googleAPIKey     string
 	parallel         bool
+	concurrency      int
+	hostConcurrency  int
 	collectorFactory collector.Factory
 	pushGatewayUrl   string
 	pushGatewayJob   string
 	categories       []string
 }
 
-func NewProbeHandler(credentialsFile string, apiKey string, parallel bool, factory collector.Factory, pushGatewayUrl string, pushGatewayJob string, categories []string) http.Handler {
+func NewProbeHandler(credentialsFile string, apiKey string, parallel bool, concurrency int, hostConcurrency int, factory collector.Factory, pushGatewayUrl string, pushGatewayJob string, categories []string) http.Handler {
 	return httpProbeHandler{
 		credentialsFile:  credentialsFile,
 		googleAPIKey:     apiKey,
 		parallel:         parallel,
+		concurrency:      concurrency,
+		hostConcurrency:  hostConcurrency,
 		collectorFactory: factory,
 		pushGatewayUrl:   pushGatewayUrl,
 		pushGatewayJob:   pushGatewayJob,
@@ -64,24 +69,30 @@ func (ph httpProbeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// set correct timeout without offset
-	ctx, cancel := context.WithTimeout(context.Background(), timeout) //Offset to calculate inits
+	// set correct timeout without offset, scrapes are canceled if prometheus gives up or the client disconnects
+	ctx, cancel := context.WithTimeout(r.Context(), timeout) //Offset to calculate inits
 	defer cancel()
 	r = r.WithContext(ctx)
 
 	registry := prometheus.NewRegistry()
 
 	psc, err := ph.collectorFactory.Create(collector.Config{
+		Context:         ctx,
 		ScrapeRequests:  requests,
 		CredentialsFile: ph.credentialsFile,
 		GoogleAPIKey:    ph.googleAPIKey,
 		Parallel:        ph.parallel,
+		Concurrency:     ph.concurrency,
+		HostConcurrency: ph.hostConcurrency,
 		ScrapeTimeout:   timeout,
 	})
 	if err != nil {
 		errResponse(w, "Could not initialize pagespeed collectors", err)
 		return
 	}
+	if closer, ok := psc.(io.Closer); ok {
+		defer closer.Close()
+	}
 
 	if err := registry.Register(psc); err != nil {
 		errResponse(w, "Could not register collectors", err)
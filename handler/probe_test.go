@@ -2,6 +2,7 @@ package handler
 
 import (
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"testing"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/foomo/pagespeed_exporter/collector"
+	"github.com/foomo/pagespeed_exporter/psitest"
 )
 
 var (
@@ -33,13 +35,60 @@ func (mockCollector) Create(config collector.Config) (prometheus.Collector, erro
 }
 
 func TestProbeHandler(t *testing.T) {
-	handler := NewProbeHandler("", "KEY", false, mockCollector{}, "", "", []string{"performance"})
+	handler := NewProbeHandler("", "KEY", false, 0, 0, mockCollector{}, "", "", []string{"performance"})
 	require.NotNil(t, handler)
 
 	require.HTTPSuccess(t, handler.ServeHTTP, "GET", "/probe", map[string][]string{"target": {"http://test.com"}})
 	require.HTTPBodyContains(t, handler.ServeHTTP, "GET", "/probe", map[string][]string{"target": {"http://test.com"}}, "test 1")
 }
 
+// recordingFactory records the config of the created collectors
+type recordingFactory struct {
+	configs *[]collector.Config
+}
+
+func (f recordingFactory) Create(config collector.Config) (prometheus.Collector, error) {
+	*f.configs = append(*f.configs, config)
+	return mockCollector{}, nil
+}
+
+func TestProbeHandlerContext(t *testing.T) {
+	var configs []collector.Config
+	handler := NewProbeHandler("", "KEY", false, 4, 2, recordingFactory{&configs}, "", "", []string{"performance"})
+
+	request := httptest.NewRequest("GET", "/probe?target=http://test.com", nil)
+	request.Header.Add(PrometheusTimeoutHeader, "10")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	require.Len(t, configs, 1)
+	require.Equal(t, 4, configs[0].Concurrency, "probe should forward the concurrency")
+	require.Equal(t, 2, configs[0].HostConcurrency, "probe should forward the host concurrency")
+	require.NotNil(t, configs[0].Context)
+	deadline, ok := configs[0].Context.Deadline()
+	require.True(t, ok, "collector context should have the probe deadline")
+	require.WithinDuration(t, time.Now().Add(10*time.Second-DefaultTimeOffset), deadline, time.Second)
+	require.Error(t, configs[0].Context.Err(), "collector context should be canceled once the probe is answered")
+}
+
+func TestProbeHandlerScheduledTarget(t *testing.T) {
+	server, fake, err := psitest.NewServer(psitest.Config{})
+	require.NoError(t, err)
+	defer server.Close()
+
+	factory := collector.NewFactory(collector.WithEndpoint(server.URL))
+	handler := NewProbeHandler("", "KEY", false, 0, 0, factory, "", "", []string{"performance"})
+
+	target := `{"url":"https://www.example.com/","strategy":"mobile","interval":"1h"}`
+	for i := 1; i <= 2; i++ {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/probe?"+url.Values{"target": {target}}.Encode(), nil))
+		require.Contains(t, recorder.Body.String(), `pagespeed_up{host="https://www.example.com",path="/",strategy="mobile"} 1`,
+			"probe should scrape targets with their own interval right away")
+		// a scheduler would only scrape the target once within its interval
+		require.Equal(t, i, fake.Requests("KEY"), "probe should scrape its targets on every request")
+	}
+}
+
 func Test_getScrapeTimeout(t *testing.T) {
 	type args struct {
 		header string
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/foomo/pagespeed_exporter/collector"
 	"github.com/foomo/pagespeed_exporter/handler"
+	"github.com/foomo/pagespeed_exporter/psitest"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -23,9 +29,36 @@ var (
 	targets         arrayFlags
 	categories      arrayFlags
 	parallel        bool
+	concurrency     int
+	hostConcurrency int
 	pushGatewayUrl  string
 	pushGatewayJob  string
 	cacheTTL        string // as duration string, e.g. "60s"
+	cacheGrace      string // as duration string, e.g. "30m"
+	cacheDir        string
+	cacheMaxEntries int
+	cacheMaxBytes   int64
+	scrapeInterval  string // as duration string, e.g. "15m"
+	rateLimits      collector.RateLimits
+	maxRetries      int
+	retryBaseDelay  time.Duration
+	retryMaxDelay   time.Duration
+	lighthousePath  string
+	chromeFlags     string
+	crux            bool
+	cruxEndpoint    string
+	cruxInterval    time.Duration
+	cruxHistory     bool
+	endpoint        string
+	proxyURL        string
+	caFile          string
+	apiKeys         string // comma separated
+	credentialsList string // comma separated
+	keyStrategy     string
+	keyDailyBudget  int
+	keyBench        time.Duration
+	recordDir       string
+	replayDir       string
 )
 
 type arrayFlags []string
@@ -40,22 +73,134 @@ func (i *arrayFlags) Set(value string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fake-psi" {
+		fakePSI(os.Args[2:])
+		return
+	}
+
 	parseFlags()
 
 	log.Infof("starting pagespeed exporter version %s on address %s for %d targets and %d categories", Version, listenerAddress, len(targets), len(categories))
 
-	collectorFactory := collector.NewFactory()
+	limiter := collector.NewRateLimiter(rateLimits)
+	if limiter != nil {
+		prometheus.MustRegister(limiter)
+	}
+
+	retryPolicy := collector.NewRetryPolicy(maxRetries, retryBaseDelay, retryMaxDelay)
+	if retryPolicy != nil {
+		prometheus.MustRegister(retryPolicy)
+	}
+
+	var parsedCacheTTL time.Duration
+	if cacheTTL != "" {
+		var err error
+		parsedCacheTTL, err = time.ParseDuration(cacheTTL)
+		if err != nil {
+			log.WithError(err).Warn("invalid CACHE_TTL, disabling cache")
+			parsedCacheTTL = 0
+		}
+	}
+
+	var parsedCacheGrace time.Duration
+	if cacheGrace != "" {
+		var err error
+		parsedCacheGrace, err = time.ParseDuration(cacheGrace)
+		if err != nil {
+			log.WithError(err).Warn("invalid CACHE_GRACE, not serving expired results")
+			parsedCacheGrace = 0
+		}
+	}
+
+	cache, errCache := collector.NewScrapeCache(collector.CacheConfig{
+		TTL:        parsedCacheTTL,
+		Grace:      parsedCacheGrace,
+		Dir:        cacheDir,
+		MaxEntries: cacheMaxEntries,
+		MaxBytes:   cacheMaxBytes,
+	})
+	if errCache != nil {
+		log.WithError(errCache).Fatal("could not instantiate cache")
+	}
+	if cache != nil {
+		prometheus.MustRegister(cache)
+	}
+
+	requestGroup := collector.NewRequestGroup()
+	prometheus.MustRegister(requestGroup)
+
+	transport, errTransport := collector.NewTransport(collector.TransportConfig{
+		ProxyURL: proxyURL,
+		CAFile:   caFile,
+	})
+	if errTransport != nil {
+		log.WithError(errTransport).Fatal("could not configure the connection to the google APIs")
+	}
+
+	keyPool, errKeys := collector.NewKeyPool(collector.KeyPoolConfig{
+		APIKeys:          splitList(apiKeys),
+		CredentialsFiles: splitList(credentialsList),
+		Strategy:         collector.KeyStrategy(keyStrategy),
+		DailyBudget:      keyDailyBudget,
+		Bench:            keyBench,
+	})
+	if errKeys != nil {
+		log.WithError(errKeys).Fatal("could not instantiate API key pool")
+	}
+	if keyPool != nil {
+		prometheus.MustRegister(keyPool)
+	}
+
+	factoryOptions := []collector.FactoryOption{
+		collector.WithRateLimiter(limiter),
+		collector.WithRetryPolicy(retryPolicy),
+		collector.WithRequestGroup(requestGroup),
+		collector.WithHostConcurrency(hostConcurrency),
+		collector.WithCache(cache),
+		collector.WithTransport(transport),
+		collector.WithEndpoint(endpoint),
+		collector.WithKeyPool(keyPool),
+	}
+	if recordDir != "" && replayDir != "" {
+		log.Fatal("record-dir and replay-dir can not be used together")
+	}
+	if recordDir != "" {
+		log.Infof("recording pagespeed API responses to %s", recordDir)
+		factoryOptions = append(factoryOptions, collector.WithRecording(recordDir))
+	}
+	if replayDir != "" {
+		log.Infof("replaying pagespeed API responses from %s instead of calling the API", replayDir)
+		factoryOptions = append(factoryOptions, collector.WithReplay(replayDir))
+	}
+
+	if lighthousePath != "" {
+		log.Infof("running lighthouse with %s instead of the pagespeed API", lighthousePath)
+		factoryOptions = append(factoryOptions, collector.WithLighthouseCLI(lighthousePath, chromeFlags))
+	}
+
+	if crux {
+		log.Infof("looking up field data with the CrUX API at %s", cruxEndpoint)
+		factoryOptions = append(factoryOptions, collector.WithCrUXAPI(cruxEndpoint, cruxInterval))
+	}
+
+	if cruxHistory {
+		log.Infof("looking up weekly field data with the CrUX History API at %s", cruxEndpoint)
+		factoryOptions = append(factoryOptions, collector.WithCrUXHistory(cruxEndpoint, cruxInterval))
+	}
+
+	collectorFactory := collector.NewFactory(factoryOptions...)
+	var closers []io.Closer
 	// Register prometheus target collectors only if there is more than one target
 	if len(targets) > 0 {
 		requests := collector.CalculateScrapeRequests(targets, categories)
 
-		var parsedCacheTTL time.Duration
-		if cacheTTL != "" {
+		var parsedScrapeInterval time.Duration
+		if scrapeInterval != "" {
 			var err error
-			parsedCacheTTL, err = time.ParseDuration(cacheTTL)
+			parsedScrapeInterval, err = time.ParseDuration(scrapeInterval)
 			if err != nil {
-				log.WithError(err).Warn("invalid CACHE_TTL, disabling cache")
-				parsedCacheTTL = 0
+				log.WithError(err).Warn("invalid PAGESPEED_SCRAPE_INTERVAL, scraping targets on collect")
+				parsedScrapeInterval = 0
 			}
 		}
 
@@ -64,35 +209,131 @@ func main() {
 			GoogleAPIKey:    googleApiKey,
 			CredentialsFile: credentialsFile,
 			Parallel:        parallel,
-			CacheTTL:        parsedCacheTTL,
+			Concurrency:     concurrency,
+			HostConcurrency: hostConcurrency,
+			ScrapeInterval:  parsedScrapeInterval,
 		})
 		if errCollector != nil {
 			log.WithError(errCollector).Fatal("could not instantiate collector")
 		}
 		prometheus.MustRegister(psc)
+		if closer, ok := psc.(io.Closer); ok {
+			closers = append(closers, closer)
+		}
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/", handler.NewIndexHandler())
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.Handle("/probe", handler.NewProbeHandler(credentialsFile, googleApiKey, parallel, collectorFactory, pushGatewayUrl, pushGatewayJob, categories))
+	mux.Handle("/probe", handler.NewProbeHandler(credentialsFile, googleApiKey, parallel, concurrency, hostConcurrency, collectorFactory, pushGatewayUrl, pushGatewayJob, categories))
 
 	server := http.Server{
 		Addr:    listenerAddress,
 		Handler: mux,
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Fatal("could not serve metrics")
+		}
+	}()
+	<-ctx.Done()
+
+	log.Info("shutting down pagespeed exporter")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.WithError(err).Warn("could not shut down the server gracefully")
+	}
+	for _, c := range closers {
+		_ = c.Close()
+	}
+}
+
+// fakePSI serves a fake pagespeed API for testing the exporter without google
+func fakePSI(args []string) {
+	fs := flag.NewFlagSet("fake-psi", flag.ExitOnError)
+	listener := fs.String("listener", getenv("PSITEST_LISTENER", ":9272"), "sets the listener address of the fake pagespeed API")
+	script := fs.String("script", getenv("PSITEST_SCRIPT", ""), "JSON file with the fixture, latency, quota and rules of the answers")
+	fixture := fs.String("fixture", getenv("PSITEST_FIXTURE", ""), "JSON file answered to successful requests, overrides the fixture of the script")
+	latency := fs.Duration("latency", getenvDuration("PSITEST_LATENCY", 0), "delay of every answer, overrides the latency of the script")
+	quota := fs.Int("quota", getenvInt("PSITEST_QUOTA", 0), "requests per API key answered before the quota is exhausted, overrides the quota of the script")
+	_ = fs.Parse(args)
+
+	var config psitest.Config
+	if *script != "" {
+		var err error
+		if config, err = psitest.LoadConfig(*script); err != nil {
+			log.WithError(err).Fatal("could not load script")
+		}
+	}
+	if *fixture != "" {
+		config.Fixture = *fixture
+	}
+	if *latency != 0 {
+		config.Latency = collector.Duration(*latency)
+	}
+	if *quota != 0 {
+		config.Quota = *quota
+	}
+
+	h, err := psitest.NewHandler(config)
+	if err != nil {
+		log.WithError(err).Fatal("could not create fake pagespeed API")
+	}
+	prometheus.MustRegister(h)
+
+	mux := http.NewServeMux()
+	mux.Handle(psitest.Path, h)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Infof("serving fake pagespeed API on address %s with %d rules", *listener, len(config.Rules))
+	server := http.Server{
+		Addr:    *listener,
+		Handler: mux,
+	}
 	log.Fatal(server.ListenAndServe())
 }
 
 func parseFlags() {
 	flag.StringVar(&cacheTTL, "cache-ttl", getenv("CACHE_TTL", ""), "cache TTL for API results, e.g. 60s. If empty, disables cache")
+	flag.StringVar(&cacheGrace, "cache-grace", getenv("CACHE_GRACE", ""), "period to serve expired results from the cache while they are refreshed, e.g. 30m. Requires cache-ttl")
+	flag.StringVar(&cacheDir, "cache-dir", getenv("CACHE_DIR", ""), "directory to persist the cache in, so results survive restarts. Requires cache-ttl")
+	flag.IntVar(&cacheMaxEntries, "cache-max-entries", getenvInt("CACHE_MAX_ENTRIES", 0), "number of results kept in the cache, the least recently used are evicted. 0 does not limit them")
+	flag.Int64Var(&cacheMaxBytes, "cache-max-bytes", int64(getenvInt("CACHE_MAX_BYTES", 0)), "size of the results kept in the cache in bytes, the least recently used are evicted. 0 does not limit it")
+	flag.StringVar(&scrapeInterval, "scrape-interval", getenv("PAGESPEED_SCRAPE_INTERVAL", ""), "refresh targets in the background at this interval, e.g. 15m. If empty, targets are scraped on every collect")
 	flag.StringVar(&googleApiKey, "api-key", getenv("PAGESPEED_API_KEY", ""), "sets the google API key used for pagespeed")
 	flag.StringVar(&credentialsFile, "credentials-file", getenv("PAGESPEED_CREDENTIALS_FILE", ""), "sets the location of the credentials file used for pagespeed")
+	flag.StringVar(&apiKeys, "api-keys", getenv("PAGESPEED_API_KEYS", ""), "comma separated pool of google API keys the pagespeed requests are spread over. api-key is only used for the CrUX APIs then")
+	flag.StringVar(&credentialsList, "credentials-files", getenv("PAGESPEED_CREDENTIALS_FILES", ""), "comma separated pool of credentials files the pagespeed requests are spread over, in addition to api-keys")
+	flag.StringVar(&keyStrategy, "key-strategy", getenv("PAGESPEED_KEY_STRATEGY", string(collector.KeyStrategyRoundRobin)), "how requests are spread over the pool of keys, round-robin or budget (the key with the most remaining daily budget)")
+	flag.IntVar(&keyDailyBudget, "key-daily-budget", getenvInt("PAGESPEED_KEY_DAILY_BUDGET", 0), "pagespeed requests per key of the pool and day, 0 does not limit them")
+	flag.DurationVar(&keyBench, "key-bench", getenvDuration("PAGESPEED_KEY_BENCH", collector.DefaultKeyBench), "period keys of the pool are not used after they were rate limited")
+	flag.StringVar(&endpoint, "endpoint", getenv("PAGESPEED_ENDPOINT", ""), "base URL of the pagespeed API, e.g. of an internal mirror or a fake. If empty, the google API is used")
+	flag.StringVar(&proxyURL, "proxy", getenv("PAGESPEED_PROXY", ""), "proxy URL of all google API requests, e.g. http://proxy:3128. If empty, the HTTP_PROXY and HTTPS_PROXY variables are used")
+	flag.StringVar(&caFile, "ca-file", getenv("PAGESPEED_CA_FILE", ""), "PEM file with root certificates trusted in addition to the system roots, e.g. of a TLS intercepting proxy")
+	flag.StringVar(&recordDir, "record-dir", getenv("PAGESPEED_RECORD_DIR", ""), "saves the raw pagespeed API responses to the directory, one file per request")
+	flag.StringVar(&replayDir, "replay-dir", getenv("PAGESPEED_REPLAY_DIR", ""), "answers pagespeed API requests with the responses recorded to the directory by record-dir instead of calling the API")
 	flag.StringVar(&listenerAddress, "listener", getenv("PAGESPEED_LISTENER", ":9271"), "sets the listener address for the exporters")
 	flag.BoolVar(&parallel, "parallel", getenv("PAGESPEED_PARALLEL", "false") == "true", "forces parallel execution for pagespeed")
+	flag.IntVar(&concurrency, "concurrency", getenvInt("PAGESPEED_CONCURRENCY", 0), "number of targets scraped at the same time. If 0, -parallel decides between one and one per CPU")
+	flag.IntVar(&hostConcurrency, "host-concurrency", getenvInt("PAGESPEED_HOST_CONCURRENCY", 0), "number of targets of the same host scraped at the same time across all collectors and probes, 0 does not limit them")
 	flag.StringVar(&pushGatewayUrl, "pushGatewayUrl", getenv("PUSHGATEWAY_URL", ""), "sets the push gateway to send the metrics. leave empty to ignore it")
 	flag.StringVar(&pushGatewayJob, "pushGatewayJob", getenv("PUSHGATEWAY_JOB", "pagespeed_exporter"), "sets push gateway job name")
+	flag.IntVar(&rateLimits.PerSecond, "rate-limit-second", getenvInt("PAGESPEED_RATE_LIMIT_SECOND", 0), "maximum pagespeed API requests per second, 0 disables the limit")
+	flag.IntVar(&rateLimits.PerMinute, "rate-limit-minute", getenvInt("PAGESPEED_RATE_LIMIT_MINUTE", 0), "maximum pagespeed API requests per minute, 0 disables the limit")
+	flag.IntVar(&rateLimits.PerDay, "rate-limit-day", getenvInt("PAGESPEED_RATE_LIMIT_DAY", 0), "maximum pagespeed API requests per day, 0 disables the limit")
+	flag.IntVar(&maxRetries, "max-retries", getenvInt("PAGESPEED_MAX_RETRIES", 0), "retries of failed pagespeed API requests with transient errors, 0 disables retries")
+	flag.DurationVar(&retryBaseDelay, "retry-base-delay", getenvDuration("PAGESPEED_RETRY_BASE_DELAY", 5*time.Second), "initial delay before retrying a failed request, doubled with every retry")
+	flag.DurationVar(&retryMaxDelay, "retry-max-delay", getenvDuration("PAGESPEED_RETRY_MAX_DELAY", time.Minute), "maximum delay before retrying a failed request")
+	flag.StringVar(&lighthousePath, "lighthouse-path", getenv("LIGHTHOUSE_PATH", ""), "runs the lighthouse binary at this path instead of the pagespeed API, e.g. /usr/local/bin/lighthouse. Field data is not available then")
+	flag.StringVar(&chromeFlags, "lighthouse-chrome-flags", getenv("LIGHTHOUSE_CHROME_FLAGS", "--headless"), "flags of the chrome browser launched by the lighthouse binary")
+	flag.BoolVar(&crux, "crux", getenv("PAGESPEED_CRUX", "false") == "true", "looks up field data in the CrUX API instead of running the pagespeed API. Combined with lighthouse-path it adds field data to the lab data")
+	flag.StringVar(&cruxEndpoint, "crux-endpoint", getenv("PAGESPEED_CRUX_ENDPOINT", collector.DefaultCrUXEndpoint), "base URL of the CrUX API")
+	flag.DurationVar(&cruxInterval, "crux-interval", getenvDuration("PAGESPEED_CRUX_INTERVAL", time.Hour), "period CrUX records are reused for, CrUX data is updated daily. 0 looks them up on every scrape")
+	flag.BoolVar(&cruxHistory, "crux-history", getenv("PAGESPEED_CRUX_HISTORY", "false") == "true", "adds the weekly field data of the last 25 collection periods from the CrUX History API")
 	targetsFlag := flag.String("targets", getenv("PAGESPEED_TARGETS", ""), "comma separated list of targets to measure")
 	categoriesFlag := flag.String("categories", getenv("PAGESPEED_CATEGORIES", "accessibility,best-practices,performance,seo"), "comma separated list of categories. overridden by categories in JSON targets")
 	flag.Var(&targets, "t", "multiple argument parameters")
@@ -111,6 +352,24 @@ func parseFlags() {
 	if len(targets) == 0 || targets[0] == "" {
 		log.Info("no targets specified, listening from collector")
 	}
+
+	if maxRetries > 0 && (retryBaseDelay <= 0 || retryMaxDelay <= 0) {
+		log.Fatal("retry-base-delay and retry-max-delay must be positive")
+	}
+	if maxRetries > 0 && retryMaxDelay < retryBaseDelay {
+		log.Fatal("retry-max-delay must not be shorter than retry-base-delay")
+	}
+}
+
+// splitList returns the non-empty values of a comma separated list
+func splitList(list string) []string {
+	var values []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
 }
 
 func getenv(key string, fallback string) string {
@@ -119,3 +378,31 @@ func getenv(key string, fallback string) string {
 	}
 	return fallback
 }
+
+func getenvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.WithError(err).Warnf("invalid %s, using default %d", key, fallback)
+		return fallback
+	}
+	return i
+}
+
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.WithError(err).Warnf("invalid %s, using default %s", key, fallback)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,258 @@
+// Package psitest provides a fake PageSpeed Insights API answering from fixture JSON, with scriptable
+// latency, errors, quota exhaustion and Lighthouse runtime errors. Point the exporter to it with
+// collector.WithEndpoint or the -endpoint flag to test scheduling, retries and caching without google.
+package psitest
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foomo/pagespeed_exporter/collector"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ prometheus.Collector = &Handler{}
+
+// Path is the path of the runPagespeed method of the API
+const Path = "/pagespeedonline/v5/runPagespeed"
+
+// DefaultFixture is the response of successful requests if the config has no fixture
+//
+//go:embed fixture.json
+var DefaultFixture []byte
+
+// defaultReasons are the error reasons of the API by status
+var defaultReasons = map[int]string{
+	http.StatusBadRequest:      "badRequest",
+	http.StatusForbidden:       "forbidden",
+	http.StatusNotFound:        "notFound",
+	http.StatusTooManyRequests: "rateLimitExceeded",
+}
+
+// Config scripts the answers of the fake API
+type Config struct {
+	Fixture string             `json:"fixture,omitempty"` // file answered to successful requests, DefaultFixture if empty
+	Latency collector.Duration `json:"latency,omitempty"` // delay of every answer
+	Quota   int                `json:"quota,omitempty"`   // requests per API key answered before the quota is exhausted, 0 does not limit them
+	Rules   []Rule             `json:"rules,omitempty"`   // the first matching rule answers a request
+}
+
+// Rule answers matching requests in place of the fixture of the config
+type Rule struct {
+	URL             string             `json:"url,omitempty"`             // target of matching requests, empty matches all
+	Strategy        string             `json:"strategy,omitempty"`        // strategy of matching requests, empty matches all
+	Times           int                `json:"times,omitempty"`           // number of requests the rule answers, 0 answers all
+	Latency         collector.Duration `json:"latency,omitempty"`         // delay of the answer instead of the latency of the config
+	Status          int                `json:"status,omitempty"`          // answers with an API error of the status
+	Reason          string             `json:"reason,omitempty"`          // reason of the API error, e.g. dailyLimitExceeded
+	LighthouseError string             `json:"lighthouseError,omitempty"` // answers with the Lighthouse runtime error, e.g. NO_FCP
+	Fixture         string             `json:"fixture,omitempty"`         // file answered in place of the fixture of the config
+}
+
+// LoadConfig reads a config from a JSON file. Relative fixture files are resolved relative to the file.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return config, errors.Wrap(err, "could not read config")
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, errors.Wrap(err, "invalid config")
+	}
+
+	dir := filepath.Dir(path)
+	resolve := func(file string) string {
+		if file == "" || filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(dir, file)
+	}
+	config.Fixture = resolve(config.Fixture)
+	for i := range config.Rules {
+		config.Rules[i].Fixture = resolve(config.Rules[i].Fixture)
+	}
+	return config, nil
+}
+
+// Handler serves the fake API
+type Handler struct {
+	config   Config
+	fixture  []byte
+	fixtures [][]byte // of the rules, nil answers with the fixture of the config
+
+	mu      sync.Mutex
+	answers []int          // number of requests answered by each rule
+	used    map[string]int // requests by API key
+
+	requests *prometheus.CounterVec
+}
+
+// NewHandler creates a handler of the config, reading its fixture files
+func NewHandler(config Config) (*Handler, error) {
+	h := &Handler{
+		config:  config,
+		fixture: DefaultFixture,
+		answers: make([]int, len(config.Rules)),
+		used:    map[string]int{},
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "psitest_requests_total",
+			Help: "Number of requests answered by the fake pagespeed API by status code",
+		}, []string{"code"}),
+	}
+
+	var err error
+	if config.Fixture != "" {
+		if h.fixture, err = readFixture(config.Fixture); err != nil {
+			return nil, err
+		}
+	}
+
+	h.fixtures = make([][]byte, len(config.Rules))
+	for i, r := range config.Rules {
+		if r.Fixture == "" {
+			continue
+		}
+		if h.fixtures[i], err = readFixture(r.Fixture); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func readFixture(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read fixture")
+	}
+	if !json.Valid(b) {
+		return nil, errors.Errorf("fixture %s is not valid JSON", path)
+	}
+	return b, nil
+}
+
+// NewServer starts a server of the fake API, closed by the caller
+func NewServer(config Config) (*httptest.Server, *Handler, error) {
+	h, err := NewHandler(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return httptest.NewServer(h), h, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != Path {
+		h.writeError(w, http.StatusNotFound, "", fmt.Sprintf("the requested URL %s was not found", r.URL.Path))
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("url") == "" {
+		h.writeError(w, http.StatusBadRequest, "", "Invalid value at 'url'")
+		return
+	}
+
+	rule, fixture, exhausted := h.match(query.Get("url"), query.Get("strategy"), query.Get("key"))
+
+	latency := time.Duration(h.config.Latency)
+	if rule != nil && rule.Latency != 0 {
+		latency = time.Duration(rule.Latency)
+	}
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch {
+	case exhausted:
+		h.writeError(w, http.StatusTooManyRequests, "rateLimitExceeded", "Quota exceeded for quota metric 'Queries' and limit 'Queries per day' of service 'pagespeedonline.googleapis.com'")
+	case rule != nil && rule.LighthouseError != "":
+		h.writeError(w, http.StatusInternalServerError, "lighthouseUserError", fmt.Sprintf("Lighthouse returned error: %s. Something went wrong.", rule.LighthouseError))
+	case rule != nil && rule.Status != 0 && rule.Status != http.StatusOK:
+		h.writeError(w, rule.Status, rule.Reason, http.StatusText(rule.Status))
+	default:
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_, _ = w.Write(fixture)
+		h.requests.WithLabelValues(strconv.Itoa(http.StatusOK)).Inc()
+	}
+}
+
+// match returns the rule and fixture answering a request, or whether the quota of the key is exhausted
+func (h *Handler) match(target, strategy, key string) (*Rule, []byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.used[key]++
+	if h.config.Quota > 0 && h.used[key] > h.config.Quota {
+		return nil, nil, true
+	}
+
+	for i := range h.config.Rules {
+		r := &h.config.Rules[i]
+		if (r.URL != "" && r.URL != target) || (r.Strategy != "" && r.Strategy != strategy) || (r.Times > 0 && h.answers[i] >= r.Times) {
+			continue
+		}
+		h.answers[i]++
+		if h.fixtures[i] != nil {
+			return r, h.fixtures[i], false
+		}
+		return r, h.fixture, false
+	}
+	return nil, h.fixture, false
+}
+
+// writeError answers with an error in the format of the google APIs
+func (h *Handler) writeError(w http.ResponseWriter, status int, reason string, message string) {
+	if reason == "" {
+		reason = defaultReasons[status]
+	}
+	if reason == "" && status >= http.StatusInternalServerError {
+		reason = "backendError"
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{
+		"code":    status,
+		"message": message,
+		"errors":  []map[string]string{{"message": message, "domain": "global", "reason": reason}},
+	}})
+	h.requests.WithLabelValues(strconv.Itoa(status)).Inc()
+}
+
+// Requests returns the number of requests made with the API key so far, including those exceeding the quota
+func (h *Handler) Requests(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.used[key]
+}
+
+// ResetQuota resets the requests of all keys, like the daily quota is reset at midnight pacific time
+func (h *Handler) ResetQuota() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.used = map[string]int{}
+}
+
+// Describe implements prometheus.Collector.
+func (h *Handler) Describe(ch chan<- *prometheus.Desc) {
+	h.requests.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (h *Handler) Collect(ch chan<- prometheus.Metric) {
+	h.requests.Collect(ch)
+}
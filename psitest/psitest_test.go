@@ -0,0 +1,242 @@
+package psitest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foomo/pagespeed_exporter/collector"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// get requests the target from the fake API, returning the status and error reason
+func get(t *testing.T, endpoint string, target string, strategy string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(endpoint + Path + "?" + url.Values{"url": {target}, "strategy": {strategy}, "key": {"KEY"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Errors  []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+		LighthouseResult json.RawMessage `json:"lighthouseResult"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("answer is not valid JSON: %v", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		if len(body.LighthouseResult) == 0 {
+			t.Error("successful answer without lighthouse result")
+		}
+		return resp.StatusCode, ""
+	}
+	if len(body.Error.Errors) != 1 || body.Error.Message == "" {
+		t.Errorf("error answer %+v, want the format of the google APIs", body.Error)
+		return resp.StatusCode, ""
+	}
+	return resp.StatusCode, body.Error.Errors[0].Reason
+}
+
+func TestHandler(t *testing.T) {
+	server, h, err := NewServer(Config{
+		Quota: 5,
+		Rules: []Rule{
+			{URL: "https://www.example.com/flaky", Times: 1, Status: http.StatusServiceUnavailable},
+			{URL: "https://www.example.com/broken", Strategy: "mobile", LighthouseError: "NO_FCP"},
+			{URL: "https://www.example.com/denied", Status: http.StatusForbidden, Reason: "dailyLimitExceeded"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer should not throw an error: %v", err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		target     string
+		strategy   string
+		wantStatus int
+		wantReason string
+	}{
+		{target: "https://www.example.com/", strategy: "mobile", wantStatus: http.StatusOK},
+		{target: "https://www.example.com/flaky", strategy: "mobile", wantStatus: http.StatusServiceUnavailable, wantReason: "backendError"},
+		{target: "https://www.example.com/flaky", strategy: "mobile", wantStatus: http.StatusOK},
+		{target: "https://www.example.com/broken", strategy: "mobile", wantStatus: http.StatusInternalServerError, wantReason: "lighthouseUserError"},
+		{target: "https://www.example.com/broken", strategy: "desktop", wantStatus: http.StatusOK},
+		{target: "https://www.example.com/denied", strategy: "desktop", wantStatus: http.StatusTooManyRequests, wantReason: "rateLimitExceeded"},
+	}
+	for i, tt := range tests {
+		status, reason := get(t, server.URL, tt.target, tt.strategy)
+		if status != tt.wantStatus || reason != tt.wantReason {
+			t.Errorf("request #%d for %s %s = %d %s, want %d %s", i, tt.target, tt.strategy, status, reason, tt.wantStatus, tt.wantReason)
+		}
+	}
+
+	if n := h.Requests("KEY"); n != 6 {
+		t.Errorf("Requests() = %d, want 6", n)
+	}
+	h.ResetQuota()
+	if status, reason := get(t, server.URL, "https://www.example.com/denied", "desktop"); status != http.StatusForbidden || reason != "dailyLimitExceeded" {
+		t.Errorf("request after the quota reset = %d %s, want the rule to answer", status, reason)
+	}
+
+	resp, err := http.Get(server.URL + "/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("request of an unknown path = %d, want 404", resp.StatusCode)
+	}
+
+	expected := `
+# HELP psitest_requests_total Number of requests answered by the fake pagespeed API by status code
+# TYPE psitest_requests_total counter
+psitest_requests_total{code="200"} 3
+psitest_requests_total{code="403"} 1
+psitest_requests_total{code="404"} 1
+psitest_requests_total{code="429"} 1
+psitest_requests_total{code="500"} 1
+psitest_requests_total{code="503"} 1
+`
+	if err := testutil.CollectAndCompare(h, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandlerLatency(t *testing.T) {
+	server, _, err := NewServer(Config{
+		Latency: collector.Duration(50 * time.Millisecond),
+		Rules:   []Rule{{URL: "https://www.example.com/slow", Latency: collector.Duration(time.Minute)}},
+	})
+	if err != nil {
+		t.Fatalf("NewServer should not throw an error: %v", err)
+	}
+	defer server.Close()
+
+	start := time.Now()
+	get(t, server.URL, "https://www.example.com/", "mobile")
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("answer took %v, want the latency of the config", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+Path+"?url=https://www.example.com/slow", nil)
+	start = time.Now()
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("request should time out before the latency of the rule")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("canceled request took %v", d)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "slow.json"), DefaultFixture, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "script.json")
+	if err := os.WriteFile(script, []byte(`{
+  "latency": "2s",
+  "quota": 100,
+  "rules": [
+    {"url": "https://www.example.com/slow", "latency": "1m", "fixture": "slow.json"},
+    {"times": 3, "status": 429}
+  ]
+}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(script)
+	if err != nil {
+		t.Fatalf("LoadConfig should not throw an error: %v", err)
+	}
+	if config.Latency != collector.Duration(2*time.Second) || config.Quota != 100 || len(config.Rules) != 2 {
+		t.Errorf("LoadConfig() = %+v, want the latency, quota and rules of the script", config)
+	}
+	if r := config.Rules[0]; r.Fixture != filepath.Join(dir, "slow.json") || r.Latency != collector.Duration(time.Minute) {
+		t.Errorf("rule = %+v, want the fixture relative to the script", r)
+	}
+	if _, err := NewHandler(config); err != nil {
+		t.Errorf("NewHandler should not throw an error: %v", err)
+	}
+
+	if _, err := NewHandler(Config{Fixture: script + ".missing"}); err == nil {
+		t.Error("NewHandler should fail for a missing fixture")
+	}
+}
+
+func TestCollector(t *testing.T) {
+	server, h, err := NewServer(Config{
+		Rules: []Rule{
+			{URL: "https://www.example.com/", Strategy: "mobile", Times: 1, LighthouseError: "NO_FCP"},
+			{URL: "https://www.example.com/other", LighthouseError: "NOT_HTML"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer should not throw an error: %v", err)
+	}
+	defer server.Close()
+
+	coll, err := collector.NewFactory(
+		collector.WithEndpoint(server.URL),
+		collector.WithRetryPolicy(collector.NewRetryPolicy(2, time.Millisecond, time.Millisecond)),
+	).Create(collector.Config{
+		GoogleAPIKey: "KEY",
+		ScrapeRequests: []collector.ScrapeRequest{
+			{Url: "https://www.example.com/", Strategy: collector.StrategyMobile, Categories: []string{collector.CategoryPerformance}},
+			{Url: "https://www.example.com/", Strategy: collector.StrategyDesktop, Categories: []string{collector.CategoryPerformance}},
+			{Url: "https://www.example.com/other", Strategy: collector.StrategyMobile, Categories: []string{collector.CategoryPerformance}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Create should not throw an error: %v", err)
+	}
+
+	// the flaky run is retried, the page lighthouse can not audit is not
+	expected := `
+# HELP pagespeed_scrape_target_error Set to 1 with the error class if the last scrape of the target failed
+# TYPE pagespeed_scrape_target_error gauge
+pagespeed_scrape_target_error{class="lighthouse",host="https://www.example.com",path="/other",strategy="mobile"} 1
+# HELP pagespeed_up Whether the last scrape of the target was successful (1) or not (0)
+# TYPE pagespeed_up gauge
+pagespeed_up{host="https://www.example.com",path="/",strategy="desktop"} 1
+pagespeed_up{host="https://www.example.com",path="/",strategy="mobile"} 1
+pagespeed_up{host="https://www.example.com",path="/other",strategy="mobile"} 0
+`
+	if err := testutil.CollectAndCompare(coll, strings.NewReader(expected), "pagespeed_scrape_target_error", "pagespeed_up"); err != nil {
+		t.Error(err)
+	}
+	if n := h.Requests("KEY"); n != 4 {
+		t.Errorf("Requests() = %d, want 4 with the retry of the flaky run", n)
+	}
+}
+
+func TestDefaultFixture(t *testing.T) {
+	var response struct {
+		LighthouseResult struct {
+			Categories map[string]json.RawMessage `json:"categories"`
+		} `json:"lighthouseResult"`
+		LoadingExperience json.RawMessage `json:"loadingExperience"`
+	}
+	if err := json.Unmarshal(DefaultFixture, &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.LighthouseResult.Categories) == 0 || len(response.LoadingExperience) == 0 {
+		t.Error("default fixture should contain lab and field data")
+	}
+}